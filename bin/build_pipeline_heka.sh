@@ -88,9 +88,16 @@ if [ ! -f "patches_applied" ]; then
     echo "Patching to build 'heka-s3list' and 'heka-s3cat'"
     patch CMakeLists.txt < $BASE/heka/patches/0003-Add-more-cmds.patch
 
+    echo "Patching to build 'heka-schema-lint'"
+    patch CMakeLists.txt < $BASE/heka/patches/0004-Add-heka-schema-lint-cmd.patch
+
+    echo "Patching to build 'heka-s3repartition'"
+    patch CMakeLists.txt < $BASE/heka/patches/0005-Add-heka-s3repartition-cmd.patch
+
     echo "Adding external plugin for s3splitfile output"
     echo "add_external_plugin(git https://github.com/mozilla-services/data-pipeline/s3splitfile :local)" >> cmake/plugin_loader.cmake
     echo "add_external_plugin(git https://github.com/mozilla-services/data-pipeline/snap :local)" >> cmake/plugin_loader.cmake
+    echo "add_external_plugin(git https://github.com/DataDog/zstd v1.4.0)" >> cmake/plugin_loader.cmake
 
     echo "Adding external plugin for golang-lru output"
     echo "add_external_plugin(git https://github.com/mreid-moz/golang-lru acc5bd27065280640fa0a79a973076c6abaccec8)" >> cmake/plugin_loader.cmake
@@ -120,6 +127,8 @@ cp -R $BASE/heka/cmd/heka-export ./cmd/
 cp -R $BASE/heka/cmd/heka-s3list ./cmd/
 cp -R $BASE/heka/cmd/heka-s3cat ./cmd/
 cp -R $BASE/heka/cmd/s3cat ./cmd/
+cp -R $BASE/heka/cmd/heka-schema-lint ./cmd/
+cp -R $BASE/heka/cmd/heka-s3repartition ./cmd/
 
 echo 'Installing/updating lua filters/modules/decoders/encoders'
 rsync -vr $BASE/heka/sandbox/ ./sandbox/lua/
@@ -128,6 +137,16 @@ echo 'Updating plugins with local changes'
 mkdir -p $BASE/build/heka/externals
 rsync -av $BASE/heka/plugins/ $BASE/build/heka/externals/
 
+# TODO: do this using cmake externals instead of shell-fu.
+echo 'Installing golang.org/x/net (for the context package)'
+GO_NET=$BASE/build/heka/build/heka/src/golang.org/x/net
+if [ ! -d $GO_NET ]; then
+    mkdir -p $(dirname $GO_NET)
+    git clone https://github.com/golang/net $GO_NET
+fi
+# Use a known revision (last "master" of 2015, which builds with go 1.4)
+(cd $GO_NET && git fetch && git checkout $(git rev-list -n 1 --before=2016-01-01 origin/master))
+
 source build.sh
 
 echo 'Installing lua-geoip libs'
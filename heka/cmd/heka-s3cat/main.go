@@ -7,7 +7,9 @@
 /*
 
 A command-line utility for counting, viewing, filtering, and extracting Heka
-protobuf logs from files on Amazon S3.
+protobuf logs from files on Amazon S3. With -splitter, files of other records,
+such as newline-delimited JSON, are read with each record as the payload of a
+message.
 
 */
 package main
@@ -23,14 +25,19 @@ import (
 	"github.com/golang/snappy"
 	"github.com/mozilla-services/data-pipeline/s3splitfile"
 	"github.com/mozilla-services/heka/message"
+	"golang.org/x/net/context"
 	"io"
 	"math"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
 	flagMatch := flag.String("match", "TRUE", "message_matcher filter expression")
+	flagSchema := flag.String("schema", "", "Filename of a schema to apply as a message_matcher, in addition to -match")
 	flagFormat := flag.String("format", "txt", "output format [txt|json|heka|count]")
 	flagOutput := flag.String("output", "", "output filename, defaults to stdout")
 	flagStdin := flag.Bool("stdin", false, "read list of s3 key names from stdin")
@@ -42,6 +49,11 @@ func main() {
 	flagWorkers := flag.Uint64("workers", 16, "number of parallel workers")
 	flagConnectTimeout := flag.Uint64("connect_timeout", 60, "Max seconds to wait for an S3 connection")
 	flagReadTimeout := flag.Uint64("read_timeout", 300, "Max seconds to wait for an S3 file read to complete")
+	flagCreatedAfter := flag.String("created-after", "", "Only read files whose names show they were created at or after this time (e.g. 2015100102)")
+	flagCreatedBefore := flag.String("created-before", "", "Only read files whose names show they were created before this time")
+	flagHostnames := flag.String("hostnames", "", "Only read files created by these hosts (comma-separated)")
+	flagSplitter := flag.String("splitter", s3splitfile.SplitterHekaFraming, "how records are split [heka|token|regex|whole]")
+	flagDelimiter := flag.String("delimiter", "", "record delimiter for the token (default newline) or regex splitters")
 	flag.Parse()
 
 	if !*flagStdin && flag.NArg() < 1 {
@@ -84,8 +96,44 @@ func main() {
 	}
 
 	var err error
+	matchExpr := *flagMatch
+	if *flagSchema != "" {
+		schema, err := s3splitfile.LoadSchema(*flagSchema)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "schema: %s\n", err)
+			os.Exit(2)
+		}
+		schemaExpr, err := schema.ToMatcher()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "schema: %s\n", err)
+			os.Exit(2)
+		}
+		if matchExpr == "TRUE" {
+			matchExpr = schemaExpr
+		} else {
+			matchExpr = fmt.Sprintf("(%s) && (%s)", schemaExpr, matchExpr)
+		}
+	}
+
+	var hostnames []string
+	if *flagHostnames != "" {
+		hostnames = strings.Split(*flagHostnames, ",")
+	}
+	nameFilter, err := s3splitfile.NewNameFilter(*flagCreatedAfter, *flagCreatedBefore, hostnames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "filter: %s\n", err)
+		os.Exit(2)
+	}
+
+	// Check the splitter settings up front; each reader makes its own.
+	if _, err = s3splitfile.NewSplitter(*flagSplitter, *flagDelimiter); err != nil {
+		fmt.Fprintf(os.Stderr, "splitter: %s\n", err)
+		os.Exit(2)
+	}
+	framed := s3splitfile.IsHekaFramingType(*flagSplitter)
+
 	var match *message.MatcherSpecification
-	if match, err = message.CreateMatcherSpecification(*flagMatch); err != nil {
+	if match, err = message.CreateMatcherSpecification(matchExpr); err != nil {
 		fmt.Fprintf(os.Stderr, "Match specification - %s\n", err)
 		os.Exit(2)
 	}
@@ -125,10 +173,20 @@ func main() {
 	doneChannel := make(chan string, 1000)
 	allDone := make(chan int)
 
+	// Stop cleanly on interrupt.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		fmt.Fprintf(os.Stderr, "Interrupted, stopping\n")
+		cancel()
+	}()
+
 	for i := 1; i <= workers; i++ {
-		go cat(bucket, filenameChannel, recordChannel, doneChannel)
+		go cat(ctx, bucket, *flagSplitter, *flagDelimiter, filenameChannel, recordChannel, doneChannel)
 	}
-	go save(recordChannel, match, *flagFormat, out, allDone)
+	go save(recordChannel, match, framed, *flagFormat, out, allDone)
 
 	startTime := time.Now().UTC()
 	totalFiles := 0
@@ -137,6 +195,10 @@ func main() {
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
 			filename := scanner.Text()
+			if !nameFilter.Allowed(filename) {
+				fmt.Fprintf(os.Stderr, "Skipping: %s\n", filename)
+				continue
+			}
 			totalFiles++
 			pendingFiles++
 			filenameChannel <- filename
@@ -148,6 +210,10 @@ func main() {
 		close(filenameChannel)
 	} else {
 		for _, filename := range flag.Args() {
+			if !nameFilter.Allowed(filename) {
+				fmt.Fprintf(os.Stderr, "Skipping: %s\n", filename)
+				continue
+			}
 			totalFiles++
 			pendingFiles++
 			filenameChannel <- filename
@@ -173,7 +239,7 @@ func main() {
 }
 
 // Cat all filenames read from filenameChannel
-func cat(bucket *s3.Bucket, filenameChannel <-chan string, recordChannel chan<- s3splitfile.S3Record, doneChannel chan<- string) {
+func cat(ctx context.Context, bucket *s3.Bucket, splitterType string, delimiter string, filenameChannel <-chan string, recordChannel chan<- s3splitfile.S3Record, doneChannel chan<- string) {
 	ok := true
 	for ok {
 		filename, ok := <-filenameChannel
@@ -182,21 +248,32 @@ func cat(bucket *s3.Bucket, filenameChannel <-chan string, recordChannel chan<-
 			break
 		}
 
-		catOne(bucket, filename, recordChannel)
+		catOne(ctx, bucket, splitterType, delimiter, filename, recordChannel)
 		doneChannel <- filename
 	}
 }
 
 // Cat the records from a single S3 key
-func catOne(bucket *s3.Bucket, s3Key string, recordChannel chan<- s3splitfile.S3Record) {
+func catOne(ctx context.Context, bucket *s3.Bucket, splitterType string, delimiter string, s3Key string, recordChannel chan<- s3splitfile.S3Record) {
 	var processed int64
 	var lastGoodOffset uint64
 
 RetryS3:
-	for attempt := 1; attempt <= 5; attempt++ {
-		for r := range s3splitfile.S3FileIterator(bucket, s3Key, lastGoodOffset) {
+	for attempt := 1; attempt <= 5 && ctx.Err() == nil; attempt++ {
+		// A fresh splitter for each attempt, so no partial record carries
+		// over from an earlier one.
+		splitter, err := s3splitfile.NewSplitter(splitterType, delimiter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", s3Key, err)
+			return
+		}
+		for r := range s3splitfile.S3FileIteratorWithSplitter(ctx, bucket, s3Key, lastGoodOffset, splitter) {
 			err := r.Err
 
+			if _, ok := err.(s3splitfile.TruncatedRecordError); ok {
+				fmt.Fprintf(os.Stderr, "Skipping end of %s at offset %d: %s\n", s3Key, r.Offset, err)
+				continue
+			}
 			if err != nil && err != io.EOF {
 				fmt.Fprintf(os.Stderr, "Error in attempt %d reading %s at offset %d: %s\n", attempt, s3Key, lastGoodOffset, err)
 				continue RetryS3
@@ -215,12 +292,15 @@ RetryS3:
 }
 
 // Save matching client records locally to the given output file in the given
-// format.
-func save(recordChannel <-chan s3splitfile.S3Record, match *message.MatcherSpecification, format string, out *os.File, done chan<- int) {
+// format. Records that aren't Heka framed become the payload of an otherwise
+// empty message.
+func save(recordChannel <-chan s3splitfile.S3Record, match *message.MatcherSpecification, framed bool, format string, out *os.File, done chan<- int) {
 	processed := 0
 	matched := 0
 	bytes := 0
 	msg := new(message.Message)
+	// Compressed files whose offsets we've warned about.
+	compressed := map[string]struct{}{}
 	ok := true
 	for ok {
 		r, ok := <-recordChannel
@@ -233,15 +313,21 @@ func save(recordChannel <-chan s3splitfile.S3Record, match *message.MatcherSpeci
 		bytes += len(r.Record)
 
 		processed += 1
-		headerLen := int(r.Record[1]) + message.HEADER_FRAMING_SIZE
-		messageBytes := r.Record[headerLen:]
-		unsnappy, decodeErr := snappy.Decode(nil, messageBytes)
-		if decodeErr == nil {
-			messageBytes = unsnappy
-		}
-		if err := proto.Unmarshal(messageBytes, msg); err != nil {
-			fmt.Fprintf(os.Stderr, "Error unmarshalling message %d in %s, error: %s\n", processed, r.Key, err)
-			continue
+		headerLen := 0
+		if framed {
+			headerLen = int(r.Record[1]) + message.HEADER_FRAMING_SIZE
+			messageBytes := r.Record[headerLen:]
+			unsnappy, decodeErr := snappy.Decode(nil, messageBytes)
+			if decodeErr == nil {
+				messageBytes = unsnappy
+			}
+			if err := proto.Unmarshal(messageBytes, msg); err != nil {
+				fmt.Fprintf(os.Stderr, "Error unmarshalling message %d in %s, error: %s\n", processed, r.Key, err)
+				continue
+			}
+		} else {
+			msg.Reset()
+			msg.SetPayload(string(r.Record))
 		}
 
 		if !match.Match(msg) {
@@ -260,6 +346,15 @@ func save(recordChannel <-chan s3splitfile.S3Record, match *message.MatcherSpeci
 			fmt.Fprintf(out, "%s", r.Record)
 		case "offsets":
 			// Use offsets mode for indexing the S3 files by clientId
+			if r.Compression != "" {
+				// The offsets are into the uncompressed data, so they
+				// can't be used to fetch the records directly.
+				if _, warned := compressed[r.Key]; !warned {
+					fmt.Fprintf(os.Stderr, "Skipping offsets for %s compressed file %s\n", r.Compression, r.Key)
+					compressed[r.Key] = struct{}{}
+				}
+				continue
+			}
 			clientId, ok := msg.GetFieldValue("clientId")
 			recordLength := len(r.Record) - headerLen
 			if ok {
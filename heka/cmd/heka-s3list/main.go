@@ -17,7 +17,11 @@ import (
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/data-pipeline/s3splitfile"
+	"golang.org/x/net/context"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -30,6 +34,19 @@ func main() {
 	flagAWSRegion := flag.String("aws-region", "us-west-2", "AWS Region")
 	flagDryRun := flag.Bool("dry-run", false, "Don't actually do anything, just output what would be done")
 	flagVerbose := flag.Bool("verbose", false, "Print detailed info")
+	flagParallel := flag.Int("parallel", 1, "Number of S3 List requests to make at once")
+	flagCacheDir := flag.String("cache-dir", "", "Directory to keep listings in between runs (disabled if empty)")
+	flagCacheDateField := flag.String("cache-date-field", "submissionDate", "Dimension holding the date of each cached prefix")
+	flagCacheHotDays := flag.Int("cache-hot-days", 2, "Always list prefixes dated within this many days again")
+	flagInventoryManifest := flag.String("inventory-manifest", "", "List keys from this S3 Inventory manifest (s3://bucket/key or a local path) instead of the S3 List API")
+	flagModifiedAfter := flag.String("modified-after", "", "Only list files last modified at or after this date (e.g. 20151001 or today-1d)")
+	flagModifiedBefore := flag.String("modified-before", "", "Only list files last modified before this date")
+	flagMinSize := flag.Int64("min-size", 0, "Only list files of at least this many bytes")
+	flagMaxSize := flag.Int64("max-size", 0, "Only list files of at most this many bytes (0 for no limit)")
+	flagCreatedAfter := flag.String("created-after", "", "Only list files whose names show they were created at or after this time (e.g. 2015100102)")
+	flagCreatedBefore := flag.String("created-before", "", "Only list files whose names show they were created before this time")
+	flagHostnames := flag.String("hostnames", "", "Only list files created by these hosts (comma-separated)")
+	flagPrintMatcher := flag.Bool("print-matcher", false, "Print the schema as a message_matcher expression instead of listing files")
 	flag.Parse()
 
 	if flag.NArg() != 0 {
@@ -45,6 +62,32 @@ func main() {
 		os.Exit(2)
 	}
 
+	keyFilter, err := s3splitfile.NewKeyFilter(*flagModifiedAfter, *flagModifiedBefore, *flagMinSize, *flagMaxSize)
+	if err != nil {
+		fmt.Printf("filter: %s\n", err)
+		os.Exit(1)
+	}
+
+	var hostnames []string
+	if *flagHostnames != "" {
+		hostnames = strings.Split(*flagHostnames, ",")
+	}
+	nameFilter, err := s3splitfile.NewNameFilter(*flagCreatedAfter, *flagCreatedBefore, hostnames)
+	if err != nil {
+		fmt.Printf("filter: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *flagPrintMatcher {
+		matcher, err := schema.ToMatcher()
+		if err != nil {
+			fmt.Printf("schema: %s\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("%s\n", matcher)
+		os.Exit(0)
+	}
+
 	if *flagDryRun {
 		fmt.Printf("Dry Run: Would have listed files in s3://%s/%s according to filter schema %s\n",
 			*flagBucket, *flagBucketPrefix, *flagSchema)
@@ -69,6 +112,16 @@ func main() {
 	s := s3.New(auth, region)
 	b = s.Bucket(*flagBucket)
 
+	// Stop cleanly on interrupt.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		fmt.Fprintf(os.Stderr, "Interrupted, stopping\n")
+		cancel()
+	}()
+
 	var errCount int
 	var totalCount int
 	var totalSize int64
@@ -76,8 +129,31 @@ func main() {
 	startTime := time.Now().UTC()
 
 	// List the keys as we see them
-	for k := range s3splitfile.S3Iterator(b, prefix, schema) {
-		if k.Err != nil {
+	var cache *s3splitfile.ListingCache
+	if *flagCacheDir != "" {
+		hotWindow := time.Duration(*flagCacheHotDays) * 24 * time.Hour
+		cache, err = s3splitfile.OpenListingCache(*flagCacheDir, *flagBucket, prefix, schema, *flagCacheDateField, hotWindow)
+		if err != nil {
+			fmt.Printf("cache-dir: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	var listing <-chan s3splitfile.S3ListResult
+	if *flagInventoryManifest != "" {
+		listing = s3splitfile.S3InventoryIterator(ctx, b, *flagInventoryManifest, prefix, schema)
+	} else {
+		listing = s3splitfile.S3CachedIterator(ctx, b, prefix, schema, *flagParallel, cache)
+	}
+
+	listing = s3splitfile.FilterKeys(ctx, listing, keyFilter)
+	for k := range s3splitfile.FilterNames(ctx, listing, nameFilter) {
+		if k.Err != nil && k.Prefix != "" {
+			// Report prefixes we couldn't list on stderr so they can be
+			// listed again separately.
+			fmt.Fprintf(os.Stderr, "ERROR listing prefix %s: %s\n", k.Prefix, k.Err)
+			errCount++
+		} else if k.Err != nil {
 			fmt.Printf("ERROR fetching key: %s\n", k.Err)
 			errCount++
 		} else {
@@ -89,8 +165,22 @@ func main() {
 
 	duration := time.Now().UTC().Sub(startTime).Seconds()
 
+	if cache != nil {
+		if err = cache.Save(); err != nil {
+			fmt.Printf("Error saving listing cache: %s\n", err)
+			errCount++
+		}
+	}
+
 	if *flagVerbose {
 		fmt.Printf("Filter matched %d files totaling %s in %.02fs (%d errors)\n",
 			totalCount, s3splitfile.PrettySize(totalSize), duration, errCount)
 	}
+
+	if errCount > 0 {
+		os.Exit(6)
+	}
+	if ctx.Err() != nil {
+		os.Exit(7)
+	}
 }
@@ -0,0 +1,21 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"github.com/rafrombrc/gospec/src/gospec"
+	"testing"
+)
+
+func TestAllSpecs(t *testing.T) {
+	r := gospec.NewRunner()
+	r.Parallel = false
+
+	r.AddSpec(RepartitionSpec)
+
+	gospec.MainGoTest(r, t)
+}
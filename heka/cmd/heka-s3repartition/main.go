@@ -0,0 +1,544 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for rewriting Heka protobuf logs on Amazon S3 from one
+schema's partition layout to another's.
+
+Each source file is read in turn, and its records are written to files under
+the new prefix according to the new schema's dimensions. The output files are
+named after the source file, so processing a source file again overwrites the
+same keys. Records go to the same partitions as S3SplitFileOutput would write
+them to, except that any max_distinct_values limits apply across the whole run
+rather than within a window of time. Source files are recorded in the progress file once all their
+records have been uploaded, and are skipped when the command is run again.
+
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/mozilla-services/data-pipeline/s3splitfile"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	flagSchema := flag.String("schema", "", "Filename of the schema describing the existing layout")
+	flagNewSchema := flag.String("new-schema", "", "Filename of the schema describing the new layout")
+	flagBucket := flag.String("bucket", "default-bucket", "S3 Bucket name")
+	flagBucketPrefix := flag.String("bucket-prefix", "", "S3 Bucket path prefix of the existing data")
+	flagNewBucket := flag.String("new-bucket", "", "S3 Bucket name for the new data, defaults to -bucket")
+	flagNewBucketPrefix := flag.String("new-bucket-prefix", "", "S3 Bucket path prefix for the new data")
+	flagAWSKey := flag.String("aws-key", "", "AWS Key")
+	flagAWSSecretKey := flag.String("aws-secret-key", "", "AWS Secret Key")
+	flagAWSRegion := flag.String("aws-region", "us-west-2", "AWS Region")
+	flagWorkDir := flag.String("work-dir", "repartition", "Local directory for files being written")
+	flagProgress := flag.String("progress", "", "File recording the source files already processed, defaults to <work-dir>/progress")
+	flagMaxFileSize := flag.Uint64("max-file-size", 500*1024*1024, "Maximum size in bytes of each new file")
+	flagMaxMessageSize := flag.Uint64("max-message-size", 4*1024*1024, "maximum message size in bytes")
+	flagWorkers := flag.Int("workers", 4, "number of source files to process in parallel")
+	flagRetries := flag.Int("retries", 5, "number of attempts for each S3 read or upload")
+	flagDryRun := flag.Bool("dry-run", false, "Don't write anything, just summarize the new partitions")
+	flagVerbose := flag.Bool("verbose", false, "Print detailed info")
+	flag.Parse()
+
+	if flag.NArg() != 0 || *flagSchema == "" || *flagNewSchema == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *flagMaxMessageSize < math.MaxUint32 {
+		message.SetMaxMessageSize(uint32(*flagMaxMessageSize))
+	} else {
+		fmt.Printf("Message size is too large: %d\n", *flagMaxMessageSize)
+		os.Exit(1)
+	}
+	if *flagWorkers < 1 || *flagRetries < 1 || *flagMaxFileSize < 1 {
+		fmt.Printf("Parameters 'workers', 'retries' and 'max-file-size' must be greater than 0\n")
+		os.Exit(1)
+	}
+
+	schema, err := s3splitfile.LoadSchema(*flagSchema)
+	if err != nil {
+		fmt.Printf("schema: %s\n", err)
+		os.Exit(2)
+	}
+	newSchema, err := s3splitfile.LoadSchema(*flagNewSchema)
+	if err != nil {
+		fmt.Printf("new-schema: %s\n", err)
+		os.Exit(2)
+	}
+
+	prefix := s3splitfile.CleanBucketPrefix(*flagBucketPrefix)
+	newPrefix := s3splitfile.CleanBucketPrefix(*flagNewBucketPrefix)
+	if *flagNewBucket == "" {
+		*flagNewBucket = *flagBucket
+	}
+	if *flagNewBucket == *flagBucket && (newPrefix == prefix || strings.HasPrefix(newPrefix, prefix)) {
+		fmt.Printf("Parameter 'new-bucket-prefix' must not be inside 'bucket-prefix'\n")
+		os.Exit(1)
+	}
+
+	progressFile := *flagProgress
+	if progressFile == "" {
+		progressFile = filepath.Join(*flagWorkDir, "progress")
+	}
+	progress, err := loadProgress(progressFile)
+	if err != nil {
+		fmt.Printf("progress: %s\n", err)
+		os.Exit(3)
+	}
+
+	auth, err := aws.GetAuth(*flagAWSKey, *flagAWSSecretKey, "", time.Now())
+	if err != nil {
+		fmt.Printf("Authentication error: %s\n", err)
+		os.Exit(4)
+	}
+	region, ok := aws.Regions[*flagAWSRegion]
+	if !ok {
+		fmt.Printf("Parameter 'aws-region' must be a valid AWS Region\n")
+		os.Exit(5)
+	}
+	// Stop cleanly on interrupt.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		fmt.Fprintf(os.Stderr, "Interrupted, stopping\n")
+		cancel()
+	}()
+
+	s := s3.New(auth, region)
+	bucket := s.Bucket(*flagBucket)
+
+	r := &repartitioner{
+		ctx:         ctx,
+		bucket:      bucket,
+		newBucket:   s.Bucket(*flagNewBucket),
+		newPrefix:   newPrefix,
+		newSchema:   newSchema,
+		cardinality: s3splitfile.NewCardinalityGuard(newSchema, 0),
+		workDir:     *flagWorkDir,
+		maxFileSize: *flagMaxFileSize,
+		retries:     *flagRetries,
+		dryRun:      *flagDryRun,
+		verbose:     *flagVerbose,
+		progress:    progress,
+		summary:     map[string]*partitionSummary{},
+		readFile: func(ctx context.Context, s3Key string, offset uint64) <-chan s3splitfile.S3Record {
+			return s3splitfile.S3FileIteratorContext(ctx, bucket, s3Key, offset)
+		},
+	}
+	if !r.dryRun {
+		if err = os.MkdirAll(r.workDir, 0700); err != nil {
+			fmt.Printf("work-dir: %s\n", err)
+			os.Exit(3)
+		}
+		if err = progress.open(); err != nil {
+			fmt.Printf("progress: %s\n", err)
+			os.Exit(3)
+		}
+		defer progress.close()
+	}
+
+	startTime := time.Now().UTC()
+
+	keys := make(chan string, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < *flagWorkers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			for key := range keys {
+				r.processKey(key, worker)
+			}
+			wg.Done()
+		}(i)
+	}
+
+	for k := range s3splitfile.S3IteratorContext(ctx, r.bucket, prefix, schema) {
+		if k.Err != nil && k.Prefix != "" {
+			fmt.Printf("ERROR listing prefix %s: %s\n", k.Prefix, k.Err)
+			r.addError()
+			continue
+		}
+		if k.Err != nil {
+			fmt.Printf("ERROR fetching key: %s\n", k.Err)
+			r.addError()
+			continue
+		}
+		if progress.isDone(k.Key.Key) {
+			r.skipped++
+			continue
+		}
+		keys <- k.Key.Key
+	}
+	close(keys)
+	wg.Wait()
+
+	duration := time.Now().UTC().Sub(startTime).Seconds()
+
+	if r.dryRun {
+		r.printSummary()
+	}
+	fmt.Printf("Processed %d files (%d records, %s, %d bad records skipped) in %.02fs, skipped %d already processed (%d errors)\n",
+		r.processed, r.records, s3splitfile.PrettySize(r.bytes), r.badRecords, duration, r.skipped, r.errors)
+	if r.errors > 0 {
+		os.Exit(6)
+	}
+	if ctx.Err() != nil {
+		fmt.Printf("Interrupted, run again to process the remaining files\n")
+		os.Exit(7)
+	}
+}
+
+// Totals for a single partition of the new layout.
+type partitionSummary struct {
+	files   int
+	records int64
+	bytes   int64
+}
+
+type repartitioner struct {
+	ctx         context.Context
+	bucket      *s3.Bucket
+	newBucket   *s3.Bucket
+	newPrefix   string
+	newSchema   s3splitfile.Schema
+	cardinality *s3splitfile.CardinalityGuard
+	workDir     string
+	maxFileSize uint64
+	retries     int
+	dryRun      bool
+	verbose     bool
+	progress    *progressLog
+
+	// Reads the records of a source file from the given offset.
+	readFile func(ctx context.Context, s3Key string, offset uint64) <-chan s3splitfile.S3Record
+
+	// Protects the counters and summary below.
+	lock       sync.Mutex
+	processed  int
+	skipped    int
+	errors     int
+	records    int64
+	badRecords int64
+	bytes      int64
+	summary    map[string]*partitionSummary
+}
+
+// A local file holding records for one partition of the new layout.
+type partFile struct {
+	dimPath string
+	name    string
+	file    *os.File
+	size    uint64
+	part    int
+}
+
+func (r *repartitioner) addError() {
+	r.lock.Lock()
+	r.errors++
+	r.lock.Unlock()
+}
+
+// Rewrite the records of a single source file into the new layout.
+func (r *repartitioner) processKey(s3Key string, worker int) {
+	localDir := filepath.Join(r.workDir, fmt.Sprintf("worker%d", worker))
+	files := map[string]*partFile{}
+	counts := map[string]*partitionSummary{}
+	var records, badRecords, bytes int64
+	failed := false
+
+	var lastGoodOffset uint64
+	done := false
+	for attempt := 1; attempt <= r.retries && !done && !failed; attempt++ {
+		done = true
+		// Stopping early must also stop the reader, which would otherwise be
+		// left blocked with the S3 response open.
+		ctx, cancel := context.WithCancel(r.ctx)
+		for rec := range r.readFile(ctx, s3Key, lastGoodOffset) {
+			switch rec.Err.(type) {
+			case s3splitfile.RecordTooLargeError, s3splitfile.TruncatedRecordError:
+				fmt.Printf("Skipping record in %s at offset %d: %s\n", s3Key, rec.Offset, rec.Err)
+				lastGoodOffset += uint64(rec.BytesRead)
+				badRecords++
+				continue
+			}
+			if rec.Err != nil && rec.Err != io.EOF {
+				fmt.Printf("Error in attempt %d reading %s at offset %d: %s\n", attempt, s3Key, lastGoodOffset, rec.Err)
+				done = false
+				break
+			}
+			lastGoodOffset += uint64(rec.BytesRead)
+			if len(rec.Record) == 0 {
+				continue
+			}
+			dimPaths, ok := r.getDimPaths(rec)
+			if !ok {
+				badRecords++
+				continue
+			}
+			if len(dimPaths) == 0 {
+				continue
+			}
+			records++
+			bytes += int64(len(rec.Record))
+			for _, dimPath := range dimPaths {
+				c, ok := counts[dimPath]
+				if !ok {
+					c = &partitionSummary{files: 1}
+					counts[dimPath] = c
+				}
+				c.records++
+				c.bytes += int64(len(rec.Record))
+				if r.dryRun {
+					continue
+				}
+				if err := r.write(files, localDir, s3Key, dimPath, rec.Record); err != nil {
+					fmt.Printf("Error writing records from %s: %s\n", s3Key, err)
+					failed = true
+					break
+				}
+			}
+			if failed {
+				break
+			}
+		}
+		cancel()
+	}
+	interrupted := r.ctx.Err() != nil
+	if !done && !failed {
+		fmt.Printf("Giving up on %s after %d attempts\n", s3Key, r.retries)
+		failed = true
+	}
+
+	// Upload the rest of the new files. After a failure, just discard them;
+	// the source file will be processed again next time.
+	for _, pf := range files {
+		if failed || interrupted {
+			pf.discard()
+		} else if err := r.upload(pf); err != nil {
+			fmt.Printf("Error uploading records from %s: %s\n", s3Key, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		r.addError()
+		return
+	}
+	if interrupted {
+		// The source file will be processed again next time.
+		return
+	}
+	if !r.dryRun {
+		if err := r.progress.markDone(s3Key); err != nil {
+			fmt.Printf("Error recording progress for %s: %s\n", s3Key, err)
+			r.addError()
+			return
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.processed++
+	r.records += records
+	r.badRecords += badRecords
+	r.bytes += bytes
+	for dimPath, c := range counts {
+		total, ok := r.summary[dimPath]
+		if !ok {
+			total = &partitionSummary{}
+			r.summary[dimPath] = total
+		}
+		total.files += c.files
+		total.records += c.records
+		total.bytes += c.bytes
+	}
+	if r.verbose {
+		fmt.Printf("%s: %d records in %d partitions\n", s3Key, records, len(counts))
+	}
+}
+
+// Get the new dimension paths for a framed record, as S3SplitFileOutput
+// would write it with the new schema. There are none if the record can't be
+// decoded, in which case `ok` is false, or if the new schema drops it.
+func (r *repartitioner) getDimPaths(rec s3splitfile.S3Record) (dimPaths []string, ok bool) {
+	headerLen := int(rec.Record[1]) + message.HEADER_FRAMING_SIZE
+	if headerLen > len(rec.Record) {
+		fmt.Printf("Bad header in %s at offset %d\n", rec.Key, rec.Offset)
+		return nil, false
+	}
+	messageBytes := rec.Record[headerLen:]
+	unsnappy, decodeErr := snappy.Decode(nil, messageBytes)
+	if decodeErr == nil {
+		messageBytes = unsnappy
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	if err := proto.Unmarshal(messageBytes, pack.Message); err != nil {
+		fmt.Printf("Error unmarshalling message in %s at offset %d: %s\n", rec.Key, rec.Offset, err)
+		return nil, false
+	}
+	return s3splitfile.GetPartitions(&r.newSchema, r.cardinality, pack, time.Now().UTC()).DimPaths, true
+}
+
+// Append a framed record to the local file for the given partition, uploading
+// the file once it reaches the maximum size.
+func (r *repartitioner) write(files map[string]*partFile, localDir, s3Key, dimPath string, record []byte) (err error) {
+	pf, ok := files[dimPath]
+	if !ok {
+		pf = &partFile{dimPath: dimPath}
+		files[dimPath] = pf
+	}
+	if pf.file == nil {
+		pf.name = s3splitfile.RepartitionedFileName(s3Key, pf.part)
+		localName := filepath.Join(localDir, dimPath, pf.name)
+		if err = os.MkdirAll(filepath.Dir(localName), 0700); err != nil {
+			return
+		}
+		if pf.file, err = os.Create(localName); err != nil {
+			return
+		}
+		pf.size = 0
+	}
+	n, err := pf.file.Write(record)
+	pf.size += uint64(n)
+	if err != nil {
+		return
+	}
+	if pf.size >= r.maxFileSize {
+		if err = r.upload(pf); err != nil {
+			return
+		}
+		pf.part++
+	}
+	return
+}
+
+// Upload a local partition file to its place in the new layout, then remove
+// it.
+func (r *repartitioner) upload(pf *partFile) (err error) {
+	if pf.file == nil {
+		return nil
+	}
+	defer pf.discard()
+
+	destPath := fmt.Sprintf("%s%s/%s", r.newPrefix, pf.dimPath, pf.name)
+	for attempt := 1; attempt <= r.retries; attempt++ {
+		if _, err = pf.file.Seek(0, 0); err != nil {
+			return
+		}
+		err = r.newBucket.PutReader(destPath, pf.file, int64(pf.size), "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
+		if err == nil {
+			if r.verbose {
+				fmt.Printf("Uploaded %s (%s)\n", destPath, s3splitfile.PrettySize(int64(pf.size)))
+			}
+			return
+		}
+		fmt.Printf("Error in attempt %d uploading %s: %s\n", attempt, destPath, err)
+	}
+	return
+}
+
+// Close and remove the local file, if any.
+func (pf *partFile) discard() {
+	if pf.file != nil {
+		pf.file.Close()
+		os.Remove(pf.file.Name())
+		pf.file = nil
+	}
+}
+
+func (r *repartitioner) printSummary() {
+	var dimPaths []string
+	for dimPath := range r.summary {
+		dimPaths = append(dimPaths, dimPath)
+	}
+	sort.Strings(dimPaths)
+	fmt.Printf("Dry Run: Would have written these partitions under %s:\n", r.newPrefix)
+	for _, dimPath := range dimPaths {
+		c := r.summary[dimPath]
+		fmt.Printf("%s\t%d source files\t%d records\t%s\n", dimPath, c.files, c.records, s3splitfile.PrettySize(c.bytes))
+	}
+}
+
+// The set of source files already processed, backed by a file with one S3
+// key per line.
+type progressLog struct {
+	filename string
+	done     map[string]struct{}
+	file     *os.File
+	lock     sync.Mutex
+}
+
+func loadProgress(filename string) (*progressLog, error) {
+	p := &progressLog{filename: filename, done: map[string]struct{}{}}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			p.done[key] = struct{}{}
+		}
+	}
+	return p, scanner.Err()
+}
+
+func (p *progressLog) open() (err error) {
+	p.file, err = os.OpenFile(p.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return
+}
+
+func (p *progressLog) close() {
+	if p.file != nil {
+		p.file.Close()
+	}
+}
+
+func (p *progressLog) isDone(s3Key string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.done[s3Key]
+	return ok
+}
+
+func (p *progressLog) markDone(s3Key string) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, err = fmt.Fprintf(p.file, "%s\n", s3Key); err != nil {
+		return
+	}
+	if err = p.file.Sync(); err != nil {
+		return
+	}
+	p.done[s3Key] = struct{}{}
+	return
+}
@@ -0,0 +1,170 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/data-pipeline/s3splitfile"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Frame a message with docType and channel fields the way Heka writes it to
+// a log.
+func frameMessage(c gs.Context, docType, channel string) []byte {
+	msg := &message.Message{}
+	f, _ := message.NewField("docType", docType, "")
+	msg.AddField(f)
+	f, _ = message.NewField("channel", channel, "")
+	msg.AddField(f)
+	msgBytes, err := proto.Marshal(msg)
+	c.Expect(err, gs.IsNil)
+
+	// The header holds just the message length, as field 1.
+	header := make([]byte, 1+binary.MaxVarintLen64)
+	header[0] = 0x08
+	header = header[:1+binary.PutUvarint(header[1:], uint64(len(msgBytes)))]
+
+	record := []byte{message.RECORD_SEPARATOR, byte(len(header))}
+	record = append(record, header...)
+	record = append(record, message.UNIT_SEPARATOR)
+	return append(record, msgBytes...)
+}
+
+func newRecord(record []byte) s3splitfile.S3Record {
+	return s3splitfile.S3Record{Record: record, BytesRead: len(record)}
+}
+
+// Source files to read without S3. Each read gets the records of the next
+// attempt, or an error once there are none left, and the offsets it starts
+// from are recorded.
+type fakeSource struct {
+	attempts [][]s3splitfile.S3Record
+	offsets  []uint64
+}
+
+func (f *fakeSource) readFile(ctx context.Context, s3Key string, offset uint64) <-chan s3splitfile.S3Record {
+	recs := []s3splitfile.S3Record{{Err: errors.New("no more attempts")}}
+	if len(f.offsets) < len(f.attempts) {
+		recs = f.attempts[len(f.offsets)]
+	}
+	f.offsets = append(f.offsets, offset)
+	recordChan := make(chan s3splitfile.S3Record, len(recs))
+	for _, rec := range recs {
+		rec.Key = s3Key
+		recordChan <- rec
+	}
+	close(recordChan)
+	return recordChan
+}
+
+func newRepartitioner(c gs.Context, source *fakeSource) *repartitioner {
+	schema, err := s3splitfile.ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+		{"field_name": "docType", "allowed_values": "*"},
+		{"field_name": "channel", "allowed_values": ["release", "beta"]}
+	]}`))
+	c.Expect(err, gs.IsNil)
+	return &repartitioner{
+		ctx:         context.Background(),
+		newSchema:   schema,
+		cardinality: s3splitfile.NewCardinalityGuard(schema, 0),
+		maxFileSize: 1024 * 1024,
+		retries:     3,
+		dryRun:      true,
+		summary:     map[string]*partitionSummary{},
+		readFile:    source.readFile,
+	}
+}
+
+func RepartitionSpec(c gs.Context) {
+	c.Specify("Partitioning", func() {
+		mainRec := frameMessage(c, "main", "release")
+		crashRec := frameMessage(c, "crash", "nightly")
+		source := &fakeSource{attempts: [][]s3splitfile.S3Record{
+			{newRecord(mainRec), newRecord(crashRec), newRecord(mainRec)},
+		}}
+		r := newRepartitioner(c, source)
+
+		dimPaths, ok := r.getDimPaths(newRecord(mainRec))
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(len(dimPaths), gs.Equals, 1)
+		c.Expect(dimPaths[0], gs.Equals, "main/release")
+		dimPaths, ok = r.getDimPaths(newRecord(crashRec))
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(dimPaths[0], gs.Equals, "crash/OTHER")
+
+		// A header longer than the record can't be decoded.
+		_, ok = r.getDimPaths(newRecord([]byte{message.RECORD_SEPARATOR, 50, 0x08}))
+		c.Expect(ok, gs.IsFalse)
+
+		r.processKey("src/file.log", 0)
+		c.Expect(r.processed, gs.Equals, 1)
+		c.Expect(r.errors, gs.Equals, 0)
+		c.Expect(r.records, gs.Equals, int64(3))
+		c.Expect(r.bytes, gs.Equals, int64(2*len(mainRec)+len(crashRec)))
+		c.Expect(len(r.summary), gs.Equals, 2)
+		c.Expect(r.summary["main/release"].files, gs.Equals, 1)
+		c.Expect(r.summary["main/release"].records, gs.Equals, int64(2))
+		c.Expect(r.summary["crash/OTHER"].records, gs.Equals, int64(1))
+		c.Expect(len(source.offsets), gs.Equals, 1)
+
+		// Records are written to a local file named after the source file,
+		// under the new dimension path.
+		dir, err := ioutil.TempDir("", "repartition")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		files := map[string]*partFile{}
+		c.Expect(r.write(files, dir, "src/file.log", "main/release", mainRec), gs.IsNil)
+		c.Expect(r.write(files, dir, "src/file.log", "main/release", mainRec), gs.IsNil)
+		pf := files["main/release"]
+		c.Expect(pf.name, gs.Equals, s3splitfile.RepartitionedFileName("src/file.log", 0))
+		c.Expect(pf.size, gs.Equals, uint64(2*len(mainRec)))
+		localName := filepath.Join(dir, "main/release", pf.name)
+		data, err := ioutil.ReadFile(localName)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(data), gs.Equals, string(mainRec)+string(mainRec))
+		pf.discard()
+		_, err = os.Stat(localName)
+		c.Expect(os.IsNotExist(err), gs.IsTrue)
+	})
+
+	c.Specify("Oversized records", func() {
+		mainRec := frameMessage(c, "main", "release")
+		tooLarge := s3splitfile.S3Record{BytesRead: 100, Err: s3splitfile.RecordTooLargeError{MaxSize: 64}}
+
+		// An oversized record is skipped without reading the file again.
+		source := &fakeSource{attempts: [][]s3splitfile.S3Record{
+			{newRecord(mainRec), tooLarge, newRecord(mainRec)},
+		}}
+		r := newRepartitioner(c, source)
+		r.processKey("src/file.log", 0)
+		c.Expect(r.processed, gs.Equals, 1)
+		c.Expect(r.errors, gs.Equals, 0)
+		c.Expect(r.records, gs.Equals, int64(2))
+		c.Expect(r.badRecords, gs.Equals, int64(1))
+		c.Expect(len(source.offsets), gs.Equals, 1)
+
+		// When a later read fails, the retry resumes after the skipped bytes.
+		source = &fakeSource{attempts: [][]s3splitfile.S3Record{
+			{newRecord(mainRec), tooLarge, {Err: errors.New("connection reset")}},
+			{newRecord(mainRec)},
+		}}
+		r = newRepartitioner(c, source)
+		r.processKey("src/file.log", 0)
+		c.Expect(r.processed, gs.Equals, 1)
+		c.Expect(r.records, gs.Equals, int64(2))
+		c.Expect(r.badRecords, gs.Equals, int64(1))
+		c.Expect(len(source.offsets), gs.Equals, 2)
+		c.Expect(source.offsets[1], gs.Equals, uint64(len(mainRec)+100))
+	})
+}
@@ -0,0 +1,60 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for checking that s3splitfile schema files are valid.
+
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mozilla-services/data-pipeline/s3splitfile"
+	"os"
+	"strings"
+)
+
+func main() {
+	flagVerbose := flag.Bool("verbose", false, "Print the dimensions of each valid schema")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] schema.json [schema.json ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var errCount int
+	for _, schemaFile := range flag.Args() {
+		schema, err := s3splitfile.LoadSchema(schemaFile)
+		if err != nil {
+			// Schema errors already include the file name and location.
+			if _, ok := err.(*s3splitfile.SchemaError); ok {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", schemaFile, err)
+			}
+			errCount++
+			continue
+		}
+
+		if *flagVerbose {
+			fmt.Printf("%s: OK (%d dimensions: %s)\n", schemaFile, len(schema.Fields),
+				strings.Join(schema.Fields, ", "))
+		} else {
+			fmt.Printf("%s: OK\n", schemaFile)
+		}
+	}
+
+	if errCount > 0 {
+		os.Exit(2)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
 	"io"
 	"io/ioutil"
 	"math"
@@ -41,7 +42,8 @@ type S3OffsetInput struct {
 	metaFileName string
 	bucket       *s3.Bucket
 	metaBucket   *s3.Bucket
-	stop         chan bool
+	ctx          context.Context
+	cancel       context.CancelFunc
 	offsetChan   chan MessageLocation
 }
 
@@ -125,14 +127,19 @@ func (input *S3OffsetInput) Init(config interface{}) (err error) {
 	// Remove any excess path separators from the bucket prefix.
 	conf.S3MetaBucketPrefix = CleanBucketPrefix(conf.S3MetaBucketPrefix)
 
-	input.stop = make(chan bool)
+	// Allow relative dates such as "today-7d" (see ResolveRelativeDate).
+	now := time.Now().UTC()
+	conf.StartDate = ResolveRelativeDate(conf.StartDate, now)
+	conf.EndDate = ResolveRelativeDate(conf.EndDate, now)
+
+	input.ctx, input.cancel = context.WithCancel(context.Background())
 	input.offsetChan = make(chan MessageLocation, 1000)
 
 	return nil
 }
 
 func (input *S3OffsetInput) Stop() {
-	close(input.stop)
+	input.cancel()
 }
 
 func (input *S3OffsetInput) Run(runner pipeline.InputRunner, helper pipeline.PluginHelper) error {
@@ -171,9 +178,9 @@ func (input *S3OffsetInput) Run(runner pipeline.InputRunner, helper pipeline.Plu
 		go func() {
 			runner.LogMessage("Starting S3 list")
 		iteratorLoop:
-			for r := range S3Iterator(input.metaBucket, input.S3MetaBucketPrefix, emptySchema) {
+			for r := range S3IteratorContext(input.ctx, input.metaBucket, input.S3MetaBucketPrefix, emptySchema) {
 				select {
-				case <-input.stop:
+				case <-input.ctx.Done():
 					runner.LogMessage("Stopping S3 list")
 					break iteratorLoop
 				default:
@@ -328,7 +335,7 @@ func (input *S3OffsetInput) fetcher(runner pipeline.InputRunner, wg *sync.WaitGr
 			duration = time.Now().UTC().Sub(startTime).Seconds()
 			runner.LogMessage(fmt.Sprintf("Successfully fetched %s in %.2fs ", loc.Key, duration))
 
-		case <-input.stop:
+		case <-input.ctx.Done():
 			runner.LogMessage("Stopping fetcher...")
 			for _ = range input.offsetChan {
 				// Drain the channel without processing anything.
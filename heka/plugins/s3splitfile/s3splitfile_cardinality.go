@@ -0,0 +1,172 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"sync"
+	"time"
+)
+
+// Limit on the number of distinct values a dimension may take within a
+// window of time. Values beyond the limit are replaced with OverflowValue.
+type DimensionLimit struct {
+	MaxDistinctValues int
+	OverflowValue     string
+}
+
+// Tracks the distinct values seen for each limited dimension of a schema,
+// replacing new values with the overflow value once a dimension's limit is
+// reached. The values seen are forgotten at the start of each window. A
+// dimension's "other" and "missing" values are never counted or replaced, as
+// they stand for values the schema has already collapsed. Safe for concurrent
+// use.
+type CardinalityGuard struct {
+	fields      []string
+	limits      []*DimensionLimit
+	fallbacks   []*DimensionFallback
+	seen        []map[string]struct{}
+	overflows   []int64
+	window      time.Duration
+	windowStart time.Time
+	lock        sync.Mutex
+}
+
+// Create a CardinalityGuard for the limited dimensions of the given schema.
+// If there are none, nil is returned, which is safe to use as a guard that
+// never limits anything.
+func NewCardinalityGuard(schema Schema, window time.Duration) *CardinalityGuard {
+	g := &CardinalityGuard{window: window}
+	for i, field := range schema.Fields {
+		limit, ok := schema.Limits[field]
+		if !ok {
+			continue
+		}
+		if limit.OverflowValue == "" {
+			// Copy the limit rather than modifying the schema's.
+			l := *limit
+			l.OverflowValue = schema.getFallback(field).OtherValue
+			limit = &l
+		}
+		for len(g.limits) < i {
+			g.limits = append(g.limits, nil)
+			g.fallbacks = append(g.fallbacks, nil)
+		}
+		g.limits = append(g.limits, limit)
+		g.fallbacks = append(g.fallbacks, schema.getFallback(field))
+	}
+	if len(g.limits) == 0 {
+		return nil
+	}
+	g.fields = schema.Fields
+	g.seen = make([]map[string]struct{}, len(g.limits))
+	g.overflows = make([]int64, len(g.limits))
+	g.reset(time.Time{})
+	return g
+}
+
+func (g *CardinalityGuard) reset(now time.Time) {
+	for i, limit := range g.limits {
+		if limit != nil {
+			g.seen[i] = map[string]struct{}{}
+		}
+	}
+	g.windowStart = now
+}
+
+// Replace any of the given dimension values that would exceed their limit
+// with the overflow value, returning true if any were replaced.
+func (g *CardinalityGuard) Check(dims []string, now time.Time) (overflow bool) {
+	return g.CheckAll([][]string{dims}, now)
+}
+
+// Like Check, for all the combinations of dimension values a single message
+// fans out to. Each distinct value of a dimension is only counted once, however
+// many of the combinations it appears in.
+func (g *CardinalityGuard) CheckAll(combinations [][]string, now time.Time) (overflow bool) {
+	if g == nil {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.windowStart.IsZero() {
+		// The first window starts with the first check.
+		g.windowStart = now
+	} else if g.window > 0 && now.Sub(g.windowStart) >= g.window {
+		g.reset(now)
+	}
+	for i, limit := range g.limits {
+		if limit == nil {
+			continue
+		}
+		// The values of this dimension replaced so far for this message.
+		var replaced map[string]bool
+		for _, dims := range combinations {
+			if i >= len(dims) {
+				continue
+			}
+			v := dims[i]
+			r, ok := replaced[v]
+			if !ok {
+				r = g.exceeds(i, v)
+				if len(combinations) > 1 {
+					if replaced == nil {
+						replaced = map[string]bool{}
+					}
+					replaced[v] = r
+				}
+			}
+			if r {
+				dims[i] = limit.OverflowValue
+				overflow = true
+			}
+		}
+	}
+	return
+}
+
+// Record a value of the i'th dimension, returning true if it should be
+// replaced by the overflow value.
+func (g *CardinalityGuard) exceeds(i int, v string) bool {
+	limit := g.limits[i]
+	if v == limit.OverflowValue || v == g.fallbacks[i].OtherValue || v == g.fallbacks[i].MissingValue {
+		return false
+	}
+	if _, ok := g.seen[i][v]; ok {
+		return false
+	}
+	if len(g.seen[i]) < limit.MaxDistinctValues {
+		g.seen[i][v] = struct{}{}
+		return false
+	}
+	g.overflows[i]++
+	return true
+}
+
+// Number of distinct values seen in the current window, and of values
+// replaced since the guard was created, for a limited dimension.
+type DimensionCardinality struct {
+	Field          string
+	DistinctValues int64
+	OverflowCount  int64
+}
+
+// Get the cardinality of each limited dimension, in schema order.
+func (g *CardinalityGuard) Counts() (counts []DimensionCardinality) {
+	if g == nil {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for i, limit := range g.limits {
+		if limit != nil {
+			counts = append(counts, DimensionCardinality{g.fields[i], int64(len(g.seen[i])), g.overflows[i]})
+		}
+	}
+	return
+}
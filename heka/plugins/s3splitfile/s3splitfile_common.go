@@ -12,12 +12,18 @@ import (
 	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PublishAttempt struct {
@@ -27,13 +33,159 @@ type PublishAttempt struct {
 
 // Encapsulates the directory-splitting schema
 type Schema struct {
-	Fields       []string
-	FieldIndices map[string]int
-	Dims         map[string]DimensionChecker
+	Fields        []string
+	FieldIndices  map[string]int
+	HeaderIndices map[string]int
+	// Dimensions whose values are computed from other message data.
+	ComputedIndices map[string]int
+	Computed        map[string]ComputedDimension
+	Dims            map[string]DimensionChecker
+	Transforms      map[string]*DimensionTransform
+	Fallbacks       map[string]*DimensionFallback
+	Limits          map[string]*DimensionLimit
+	// Dimension path prefix for quarantined messages.
+	QuarantinePrefix string
+	// How dimension values are encoded in S3 paths (see EncodeDimension).
+	Encoding string
+}
+
+// What to do with a message when one of its dimensions is not allowed or is
+// missing.
+const (
+	// Use the fallback value as the dimension value.
+	FallbackReplace = "replace"
+	// Discard the message.
+	FallbackDrop = "drop"
+	// Use the fallback value, and write the message under the schema's
+	// quarantine prefix.
+	FallbackQuarantine = "quarantine"
+)
+
+const (
+	defaultOtherValue       = "OTHER"
+	defaultMissingValue     = "UNKNOWN"
+	defaultQuarantinePrefix = "quarantine"
+)
+
+// Per-dimension values (and actions) to use in place of values that are not
+// allowed ("other") or not present ("missing").
+type DimensionFallback struct {
+	OtherValue   string
+	MissingValue string
+	OnOther      string
+	OnMissing    string
+}
+
+// The fallback used for dimensions that don't specify their own.
+var defaultFallback = DimensionFallback{defaultOtherValue, defaultMissingValue, FallbackReplace, FallbackReplace}
+
+func (s *Schema) getFallback(field string) *DimensionFallback {
+	if fb, ok := s.Fallbacks[field]; ok {
+		return fb
+	}
+	return &defaultFallback
+}
+
+// Encapsulates the dimensions extracted from a message, along with what
+// happened when checking them.
+type DimensionResult struct {
+	Dims []string
+	// At least one dimension was replaced by its "other" value.
+	Other bool
+	// At least one dimension was replaced by its "missing" value.
+	Missing bool
+	// The message should be discarded.
+	Drop bool
+	// The message should be written under the quarantine prefix.
+	Quarantine bool
+}
+
+func (r *DimensionResult) applyAction(action string) {
+	switch action {
+	case FallbackDrop:
+		r.Drop = true
+	case FallbackQuarantine:
+		r.Quarantine = true
+	}
+}
+
+// Normalizes raw dimension values (schema version 2 and up) so that variants
+// of the same value end up in the same partition. Transforms are applied in
+// the order: default, lowercase, aliases, max_length.
+type DimensionTransform struct {
+	// Value to use when the dimension is missing or empty.
+	Default string
+	// Convert the value to lower case.
+	Lowercase bool
+	// Replace values found in this map with the corresponding canonical value.
+	Aliases map[string]string
+	// Truncate values longer than this many characters (0 means no limit).
+	MaxLength int
+}
+
+func (dt *DimensionTransform) Apply(v string) string {
+	if v == "" {
+		v = dt.Default
+	}
+	if dt.Lowercase {
+		v = strings.ToLower(v)
+	}
+	if alias, ok := dt.Aliases[v]; ok {
+		v = alias
+	}
+	if dt.MaxLength > 0 {
+		if runes := []rune(v); len(runes) > dt.MaxLength {
+			v = string(runes[:dt.MaxLength])
+		}
+	}
+	return v
+}
+
+// Top-level message fields that may be used as dimensions via `header_name`.
+// This is the same set accepted by the `telemetry/s3.lua` spec.
+var validHeaders = map[string]struct{}{
+	"Uuid":       struct{}{},
+	"Timestamp":  struct{}{},
+	"Type":       struct{}{},
+	"Logger":     struct{}{},
+	"Severity":   struct{}{},
+	"Payload":    struct{}{},
+	"EnvVersion": struct{}{},
+	"Pid":        struct{}{},
+	"Hostname":   struct{}{},
+}
+
+// Layout used when the message Timestamp is used as a dimension. It matches
+// the format of the `submissionDate` field.
+const timestampDimensionLayout = "20060102"
+
+// Get the string value of a top-level message field.
+func getHeaderValue(msg *message.Message, name string) string {
+	switch name {
+	case "Uuid":
+		return msg.GetUuidString()
+	case "Timestamp":
+		return time.Unix(0, msg.GetTimestamp()).UTC().Format(timestampDimensionLayout)
+	case "Type":
+		return msg.GetType()
+	case "Logger":
+		return msg.GetLogger()
+	case "Severity":
+		return fmt.Sprintf("%d", msg.GetSeverity())
+	case "Payload":
+		return msg.GetPayload()
+	case "EnvVersion":
+		return msg.GetEnvVersion()
+	case "Pid":
+		return fmt.Sprintf("%d", msg.GetPid())
+	case "Hostname":
+		return msg.GetHostname()
+	}
+	return ""
 }
 
 // Determine whether a given value is acceptable for a given field, and if not
-// return a default value instead.
+// return the field's "other" value instead.
 func (s *Schema) GetValue(field string, value string) (rvalue string, err error) {
 	checker, ok := s.Dims[field]
 	if !ok {
@@ -42,19 +194,97 @@ func (s *Schema) GetValue(field string, value string) (rvalue string, err error)
 	if checker.IsAllowed(value) {
 		return value, nil
 	} else {
-		return "OTHER", nil
+		return s.getFallback(field).OtherValue, nil
 	}
 }
 
 // Extract all dimensions from the given pack.
 func (s *Schema) GetDimensions(pack *PipelinePack) (dimensions []string) {
-	dims := make([]string, len(s.Fields))
-	for i, _ := range dims {
-		dims[i] = "UNKNOWN"
+	return s.CheckDimensions(pack).Dims
+}
+
+// Extract all dimensions from the given pack, reporting whether any fallback
+// values were used and what should be done with the message as a result.
+func (s *Schema) CheckDimensions(pack *PipelinePack) (result DimensionResult) {
+	return s.checkRawDimensions(s.getRawDimensions(pack))
+}
+
+// Like CheckDimensions, but with one result for each combination of values
+// of any "fan_out" dimensions, so that a message can be written to several
+// partitions. There is always at least one result.
+func (s *Schema) CheckAllDimensions(pack *PipelinePack) (results []DimensionResult) {
+	raw := s.getRawDimensions(pack)
+	combinations := [][]string{raw}
+	for idx, name := range s.Fields {
+		fs, ok := s.Computed[name].(*FieldSelector)
+		if !ok || fs.MultiValue != MultiValueFanOut {
+			continue
+		}
+		values := fs.Values(pack.Message)
+		if len(values) < 2 {
+			continue
+		}
+		var expanded [][]string
+		for _, c := range combinations {
+			seen := map[string]struct{}{}
+			for _, v := range values {
+				if _, dup := seen[v]; dup {
+					continue
+				}
+				seen[v] = struct{}{}
+				combination := make([]string, len(c))
+				copy(combination, c)
+				combination[idx] = v
+				expanded = append(expanded, combination)
+			}
+		}
+		combinations = expanded
+	}
+	results = make([]DimensionResult, len(combinations))
+	for i, c := range combinations {
+		results[i] = s.checkRawDimensions(c)
 	}
+	return
+}
 
-	// TODO: add support for top-level message fields (Timestamp, etc)
-	remaining := len(dims)
+// Transform and check the given raw dimension values.
+func (s *Schema) checkRawDimensions(raw []string) (result DimensionResult) {
+	result.Dims = make([]string, len(s.Fields))
+	for i, value := range raw {
+		field := s.Fields[i]
+		if t, ok := s.Transforms[field]; ok {
+			value = t.Apply(value)
+		}
+		fallback := s.getFallback(field)
+		if value == "" {
+			// The value was missing or an empty string.
+			result.Dims[i] = fallback.MissingValue
+			result.Missing = true
+			result.applyAction(fallback.OnMissing)
+			continue
+		}
+		checker, ok := s.Dims[field]
+		if !ok {
+			fmt.Printf("How did this happen? No such field: '%s'", field)
+		}
+		if !ok || checker.IsAllowed(value) {
+			result.Dims[i] = value
+		} else {
+			result.Dims[i] = fallback.OtherValue
+			result.Other = true
+			result.applyAction(fallback.OnOther)
+		}
+	}
+
+	return
+}
+
+// Extract the raw (unchecked) value of each dimension from the given pack.
+// Missing values are returned as "".
+func (s *Schema) getRawDimensions(pack *PipelinePack) (raw []string) {
+	raw = make([]string, len(s.Fields))
+
+	remaining := len(s.FieldIndices)
 	for _, field := range pack.Message.Fields {
 		if remaining == 0 {
 			break
@@ -67,18 +297,208 @@ func (s *Schema) GetDimensions(pack *PipelinePack) (dimensions []string) {
 			// provided.
 			inValue := field.GetValue()
 			if inValue != nil {
-				v, err := s.GetValue(field.GetName(), fmt.Sprintf("%v", inValue))
-				if err != nil {
-					fmt.Printf("How did this happen? %s", err)
-				}
-				if v != "" {
-					dims[idx] = v
-				} // Else the value was an empty string, leave as unknown.
-			} // Else there were no values, leave this field as unknown.
+				raw[idx] = fmt.Sprintf("%v", inValue)
+			} // Else there were no values, leave this field as missing.
+		}
+	}
+
+	for name, idx := range s.HeaderIndices {
+		raw[idx] = getHeaderValue(pack.Message, name)
+	}
+
+	for name, idx := range s.ComputedIndices {
+		raw[idx] = s.Computed[name].Compute(pack.Message)
+	}
+
+	return raw
+}
+
+// Get the string value of a message header (if `name` is one of the valid
+// header names) or else of the first value of the named message field.
+// Missing values are returned as "".
+func getSourceValue(msg *message.Message, name string) string {
+	if _, ok := validHeaders[name]; ok {
+		return getHeaderValue(msg, name)
+	}
+	if value, ok := msg.GetFieldValue(name); ok && value != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
+
+// Interface for dimensions whose values are computed from a message rather
+// than read from a single field. An empty result is treated as missing.
+type ComputedDimension interface {
+	Compute(msg *message.Message) string
+}
+
+// Dimension that assigns each message to one of a fixed number of buckets
+// based on the hash of another header or field, e.g. a stable sample id
+// derived from `clientId`. The bucket is the CRC-32 (IEEE) checksum of the
+// source value modulo the number of buckets, so it can be reproduced by
+// other tools.
+type HashDimension struct {
+	Source  string
+	Buckets uint32
+}
+
+func (hd *HashDimension) Compute(msg *message.Message) string {
+	value := getSourceValue(msg, hd.Source)
+	if value == "" {
+		return ""
+	}
+	return HashBucket(value, hd.Buckets)
+}
+
+// Dimension that formats a time taken from the message Timestamp or from
+// another field, truncated to a bucket size such as "1h". Numeric fields are
+// treated like the Timestamp, as nanoseconds since the epoch, and string
+// fields may use any of the layouts accepted by ParseDate. Times are
+// formatted in UTC.
+type TimeBucketDimension struct {
+	Source      string
+	Layout      string
+	Granularity time.Duration
+}
+
+func (td *TimeBucketDimension) Compute(msg *message.Message) string {
+	var t time.Time
+	if td.Source == "Timestamp" {
+		t = time.Unix(0, msg.GetTimestamp())
+	} else {
+		value, ok := msg.GetFieldValue(td.Source)
+		if !ok {
+			return ""
+		}
+		switch v := value.(type) {
+		case int64:
+			t = time.Unix(0, v)
+		case float64:
+			t = time.Unix(0, int64(v))
+		case string:
+			var err error
+			if t, err = ParseDate(v); err != nil {
+				return ""
+			}
+		default:
+			return ""
+		}
+	}
+	t = t.UTC()
+	if td.Granularity > 0 {
+		t = t.Truncate(td.Granularity)
+	}
+	return t.Format(td.Layout)
+}
+
+// How to choose a dimension value from a field with several values.
+const (
+	// Use the first value.
+	MultiValueFirst = "first"
+	// Use the last value.
+	MultiValueLast = "last"
+	// Join all the values with a separator.
+	MultiValueJoined = "joined"
+	// Write the message to the partition for each value (see
+	// CheckAllDimensions). Elsewhere, the first value is used.
+	MultiValueFanOut = "fan_out"
+)
+
+// Pattern for Heka-style field addresses: Fields[name][fieldIndex][arrayIndex]
+var fieldAddressPattern = regexp.MustCompile(`^Fields\[([^\[\]]+)\](?:\[([0-9]+)\])?(?:\[([0-9]+)\])?$`)
+
+// Dimension that selects a value from a particular occurrence of a message
+// field (`FieldIndex`, counting fields with the same name), either a single
+// value from its array of values (`ArrayIndex`) or, if ArrayIndex is -1,
+// according to the MultiValue policy.
+type FieldSelector struct {
+	Name       string
+	FieldIndex int
+	ArrayIndex int
+	MultiValue string
+	Separator  string
+}
+
+// Parse a field name, which may be a plain name or a Heka-style address such
+// as "Fields[name][0][1]".
+func ParseFieldSelector(fieldName string) (*FieldSelector, error) {
+	fs := &FieldSelector{Name: fieldName, ArrayIndex: -1, MultiValue: MultiValueFirst}
+	if !strings.HasPrefix(fieldName, "Fields[") {
+		return fs, nil
+	}
+	m := fieldAddressPattern.FindStringSubmatch(fieldName)
+	if m == nil {
+		return nil, fmt.Errorf("Invalid field address '%s'", fieldName)
+	}
+	fs.Name = m[1]
+	if m[2] != "" {
+		fs.FieldIndex, _ = strconv.Atoi(m[2])
+	}
+	if m[3] != "" {
+		fs.ArrayIndex, _ = strconv.Atoi(m[3])
+	}
+	return fs, nil
+}
+
+// Get the selected values of the field, before applying the MultiValue
+// policy.
+func (fs *FieldSelector) Values(msg *message.Message) []string {
+	fields := msg.FindAllFields(fs.Name)
+	if fs.FieldIndex >= len(fields) {
+		return nil
+	}
+	values := fieldValues(fields[fs.FieldIndex])
+	if fs.ArrayIndex < 0 {
+		return values
+	}
+	if fs.ArrayIndex >= len(values) {
+		return nil
+	}
+	return values[fs.ArrayIndex : fs.ArrayIndex+1]
+}
+
+func (fs *FieldSelector) Compute(msg *message.Message) string {
+	values := fs.Values(msg)
+	if len(values) == 0 {
+		return ""
+	}
+	switch fs.MultiValue {
+	case MultiValueLast:
+		return values[len(values)-1]
+	case MultiValueJoined:
+		return strings.Join(values, fs.Separator)
+	}
+	return values[0]
+}
+
+// Get all the values of a field as strings.
+func fieldValues(field *message.Field) (values []string) {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		return field.GetValueString()
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, fmt.Sprintf("%v", v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, fmt.Sprintf("%v", v))
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, fmt.Sprintf("%v", v))
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, fmt.Sprintf("%v", v))
 		}
 	}
+	return
+}
 
-	return dims
+// Get the bucket (from 0 to buckets - 1) for the given value.
+func HashBucket(value string, buckets uint32) string {
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(value))%buckets), 10)
 }
 
 // Interface for calculating whether a particular value is acceptable
@@ -105,10 +525,15 @@ func (adc AnyDimensionChecker) ListValues() ([]string, bool) {
 type ListDimensionChecker struct {
 	// Use a map instead of a list internally for fast lookups.
 	allowed map[string]struct{}
+	// Compare values as-is rather than sanitizing them.
+	exact bool
 }
 
 func (ldc ListDimensionChecker) IsAllowed(v string) bool {
-	_, ok := ldc.allowed[SanitizeDimension(v)]
+	if !ldc.exact {
+		v = SanitizeDimension(v)
+	}
+	_, ok := ldc.allowed[v]
 	return ok
 }
 
@@ -128,18 +553,51 @@ func NewListDimensionChecker(allowed []string) *ListDimensionChecker {
 	for _, a := range allowed {
 		dimMap[SanitizeDimension(a)] = struct{}{}
 	}
-	return &ListDimensionChecker{dimMap}
+	return &ListDimensionChecker{dimMap, false}
+}
+
+// Factory for creating a ListDimensionChecker that doesn't sanitize values,
+// for use with reversible encodings.
+func NewExactListDimensionChecker(allowed []string) *ListDimensionChecker {
+	dimMap := map[string]struct{}{}
+	for _, a := range allowed {
+		dimMap[a] = struct{}{}
+	}
+	return &ListDimensionChecker{dimMap, true}
 }
 
 // If both are specified, accept any value between `min` and `max` (inclusive).
 // If one of the bounds is missing, only enforce the other. If neither bound is
-// present, accept all values.
+// present, accept all values. Values are compared as strings unless a typed
+// comparison was requested, in which case values that can't be parsed as that
+// type are not accepted. Bounds may be relative date expressions (see
+// ResolveRelativeDate), which are re-evaluated by Refresh.
 type RangeDimensionChecker struct {
-	min string
-	max string
+	min     string
+	max     string
+	compare RangeComparator
+	minExpr string
+	maxExpr string
+
+	// Name of the typed comparison (a key of RangeComparators), if any.
+	rangeType string
 }
 
 func (rdc RangeDimensionChecker) IsAllowed(v string) bool {
+	if rdc.compare != nil {
+		if rdc.min != "" {
+			if c, err := rdc.compare(v, rdc.min); err != nil || c < 0 {
+				return false
+			}
+		}
+		if rdc.max != "" {
+			if c, err := rdc.compare(v, rdc.max); err != nil || c > 0 {
+				return false
+			}
+		}
+		return true
+	}
+
 	// Min and max are optional, so treat them separately.
 	// TODO: ensure that Go does string comparisons in the fashion expected
 	//       by this code.
@@ -158,6 +616,292 @@ func (rdc RangeDimensionChecker) ListValues() ([]string, bool) {
 	return nil, false
 }
 
+// Re-evaluate any relative date bounds as of the given time.
+func (rdc *RangeDimensionChecker) Refresh(now time.Time) {
+	rdc.min = ResolveRelativeDate(rdc.minExpr, now)
+	rdc.max = ResolveRelativeDate(rdc.maxExpr, now)
+}
+
+// Factory for creating a RangeDimensionChecker. The `rangeType` is one of the
+// keys of RangeComparators, or "" for a plain string comparison.
+func NewRangeDimensionChecker(min, max, rangeType string) (*RangeDimensionChecker, error) {
+	rdc := &RangeDimensionChecker{minExpr: min, maxExpr: max}
+	rdc.Refresh(time.Now())
+	if rangeType == "" || rangeType == "string" {
+		return rdc, nil
+	}
+	compare, ok := RangeComparators[rangeType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown range type '%s'", rangeType)
+	}
+	for _, bound := range []string{rdc.min, rdc.max} {
+		if bound == "" {
+			continue
+		}
+		if _, err := compare(bound, bound); err != nil {
+			return nil, fmt.Errorf("Invalid %s bound '%s': %s", rangeType, bound, err)
+		}
+	}
+	rdc.compare = compare
+	rdc.rangeType = rangeType
+	return rdc, nil
+}
+
+// Checkers whose allowed values depend on the current time.
+type RefreshableDimensionChecker interface {
+	Refresh(now time.Time)
+}
+
+// Re-evaluate any time-dependent dimensions (such as ranges using relative
+// dates) as of the given time. Long-running readers should call this before
+// each listing pass.
+func (s *Schema) Refresh(now time.Time) {
+	for _, checker := range s.Dims {
+		if rc, ok := checker.(RefreshableDimensionChecker); ok {
+			rc.Refresh(now)
+		}
+	}
+}
+
+// Pattern for relative date expressions such as "today", "today-7d" or
+// "today+1w".
+var relativeDatePattern = regexp.MustCompile("^today(?:([+-])([0-9]+)([dw]))?$")
+
+// If `expr` is a relative date expression, return the corresponding date (as
+// "YYYYMMDD", in UTC) relative to `now`. Any other value is returned as-is.
+func ResolveRelativeDate(expr string, now time.Time) string {
+	m := relativeDatePattern.FindStringSubmatch(expr)
+	if m == nil {
+		return expr
+	}
+	days := 0
+	if m[1] != "" {
+		// The pattern guarantees that this is a valid number.
+		days, _ = strconv.Atoi(m[2])
+		if m[3] == "w" {
+			days *= 7
+		}
+		if m[1] == "-" {
+			days = -days
+		}
+	}
+	return now.UTC().AddDate(0, 0, days).Format(timestampDimensionLayout)
+}
+
+// Compare two values, returning a negative number if a < b, zero if a == b
+// and a positive number if a > b. An error is returned if either value can't
+// be interpreted.
+type RangeComparator func(a, b string) (int, error)
+
+// Available range types.
+var RangeComparators = map[string]RangeComparator{
+	"numeric": CompareNumeric,
+	"date":    CompareDates,
+	"version": CompareVersions,
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Compare values as decimal numbers.
+func CompareNumeric(a, b string) (int, error) {
+	fa, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return 0, err
+	}
+	fb, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return 0, err
+	}
+	return compareFloats(fa, fb), nil
+}
+
+// Date layouts understood by the "date" range type.
+var dateLayouts = []string{
+	"20060102",
+	"2006-01-02",
+	"2006010215",
+	"20060102150405",
+	time.RFC3339,
+}
+
+// Parse a date using any of the known date layouts.
+func ParseDate(v string) (t time.Time, err error) {
+	for _, layout := range dateLayouts {
+		if t, err = time.Parse(layout, v); err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("Unrecognized date: '%s'", v)
+}
+
+// Compare values as dates (for example "20150131" or "2015-01-31").
+func CompareDates(a, b string) (int, error) {
+	ta, err := ParseDate(a)
+	if err != nil {
+		return 0, err
+	}
+	tb, err := ParseDate(b)
+	if err != nil {
+		return 0, err
+	}
+	return compareInts(ta.UnixNano(), tb.UnixNano()), nil
+}
+
+// Pattern for one dot-separated version component such as "0", "0a1" or
+// "0b2".
+var versionPartPattern = regexp.MustCompile("^([0-9]+)([a-zA-Z]*)([0-9]*)$")
+
+type versionPart struct {
+	number    int64
+	tag       string
+	tagNumber int64
+}
+
+func parseVersion(v string) ([]versionPart, error) {
+	pieces := strings.Split(v, ".")
+	parts := make([]versionPart, len(pieces))
+	for i, p := range pieces {
+		m := versionPartPattern.FindStringSubmatch(p)
+		if m == nil {
+			return nil, fmt.Errorf("Invalid version: '%s'", v)
+		}
+		parts[i].number, _ = strconv.ParseInt(m[1], 10, 64)
+		parts[i].tag = m[2]
+		if m[3] != "" {
+			parts[i].tagNumber, _ = strconv.ParseInt(m[3], 10, 64)
+		}
+	}
+	return parts, nil
+}
+
+// Compare values as dotted version numbers, such that "9.0" < "45.0a1" <
+// "45.0b2" < "45.0" < "45.0.1". Missing components count as zero, and a
+// component with a pre-release tag ("a1", "b2") sorts before the same
+// component without one.
+func CompareVersions(a, b string) (int, error) {
+	pa, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	pb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for len(pa) < len(pb) {
+		pa = append(pa, versionPart{})
+	}
+	for len(pb) < len(pa) {
+		pb = append(pb, versionPart{})
+	}
+	for i := range pa {
+		if c := compareInts(pa[i].number, pb[i].number); c != 0 {
+			return c, nil
+		}
+		if pa[i].tag != pb[i].tag {
+			if pa[i].tag == "" {
+				return 1, nil
+			}
+			if pb[i].tag == "" {
+				return -1, nil
+			}
+			if pa[i].tag < pb[i].tag {
+				return -1, nil
+			}
+			return 1, nil
+		}
+		if c := compareInts(pa[i].tagNumber, pb[i].tagNumber); c != 0 {
+			return c, nil
+		}
+	}
+	return 0, nil
+}
+
+// Checkers that can tell us a literal prefix shared by all allowed values,
+// which lets us narrow down S3 listings.
+type PrefixDimensionChecker interface {
+	ListPrefix() string
+}
+
+// Accept any value matching a regular expression.
+type PatternDimensionChecker struct {
+	pattern *regexp.Regexp
+	prefix  string
+}
+
+func (pdc PatternDimensionChecker) IsAllowed(v string) bool {
+	return pdc.pattern.MatchString(v)
+}
+
+func (pdc PatternDimensionChecker) ListValues() ([]string, bool) {
+	return nil, false
+}
+
+// Return the literal prefix that every allowed value must begin with (if the
+// pattern is anchored at the start), or "" if there is no such prefix.
+func (pdc PatternDimensionChecker) ListPrefix() string {
+	return pdc.prefix
+}
+
+// Factory for creating a PatternDimensionChecker from a regular expression.
+func NewPatternDimensionChecker(pattern string) (*PatternDimensionChecker, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if strings.HasPrefix(pattern, "^") {
+		// Only an anchored pattern guarantees that every match starts with
+		// its literal prefix.
+		if unanchored, err := regexp.Compile(pattern[1:]); err == nil {
+			prefix, _ = unanchored.LiteralPrefix()
+		}
+	}
+	return &PatternDimensionChecker{re, prefix}, nil
+}
+
+// Accept any value that is NOT accepted by another checker.
+type NotDimensionChecker struct {
+	excluded DimensionChecker
+}
+
+func (ndc NotDimensionChecker) IsAllowed(v string) bool {
+	return !ndc.excluded.IsAllowed(v)
+}
+
+// The allowed values can't be enumerated, so S3 listings must check each
+// prefix.
+func (ndc NotDimensionChecker) ListValues() ([]string, bool) {
+	return nil, false
+}
+
+func (ndc NotDimensionChecker) Refresh(now time.Time) {
+	if rc, ok := ndc.excluded.(RefreshableDimensionChecker); ok {
+		rc.Refresh(now)
+	}
+}
+
+// Factory for creating a NotDimensionChecker that accepts everything the
+// given checker does not.
+func NewNotDimensionChecker(excluded DimensionChecker) *NotDimensionChecker {
+	return &NotDimensionChecker{excluded}
+}
+
 // Pattern to use for sanitizing path/file components.
 var sanitizePattern = regexp.MustCompile("[^a-zA-Z0-9_/.]")
 
@@ -169,11 +913,62 @@ func SanitizeDimension(dim string) (cleaned string) {
 
 // Load a schema from the given file name.  The file is expected to contain
 // valid JSON describing a hierarchy of dimensions, each of which specifies
-// what values are "allowed" for that dimension.
+// what values are "allowed" for that dimension. A dimension is either a
+// message field (`field_name`) or a top-level message header (`header_name`,
+// one of Uuid, Timestamp, Type, Logger, Severity, Payload, EnvVersion, Pid
+// or Hostname). The Timestamp header is formatted as "YYYYMMDD" in UTC.
+// A dimension may instead be computed by hashing another field or header into
+// a fixed number of buckets (`"hash_of": "clientId", "buckets": 100`), which
+// gives a stable sample id; see HashDimension. Its "allowed_values" default to
+// "*".
+//
+// Similarly, a dimension may be derived from the message Timestamp or a time
+// field, formatted with a Go time layout (default "20060102") after being
+// truncated to a "granularity" (such as "1h"), for example
+// `{ "derived": "Timestamp", "format": "2006010215", "granularity": "1h" }`.
+// The dimension is named after its source unless "field_name" is given, and
+// its "allowed_values" also default to "*"; see TimeBucketDimension. Values
+// that can't be parsed as times are treated as missing.
+//
+// Any "allowed_values" spec may be negated by wrapping it as { "not": ... },
+// which allows every value except the ones it matches.
+// Ranges compare values as strings unless a "type" of "numeric", "date" or
+// "version" is given. Range bounds may be relative dates such as "today" or
+// "today-7d", evaluated in UTC when the schema is loaded.
+//
+// Any dimension may set the values used in place of values that are not
+// allowed ("other_value", default "OTHER") or are missing ("missing_value",
+// default "UNKNOWN"). Setting "on_other" or "on_missing" to "drop" discards
+// such messages instead, and "quarantine" writes them under the schema's
+// "quarantine_prefix" (default "quarantine").
+//
+// Version 2 schemas may also specify a "transform" for each dimension, which
+// is applied to the raw value before checking it against the allowed values:
+//   { "field_name": "appName", "allowed_values": ["firefox", "fennec"],
+//     "transform": { "lowercase": true, "aliases": { "fx": "firefox" },
+//                    "max_length": 32, "default": "firefox" } }
+//
+// A "field_name" may use Heka's field address syntax to pick a particular
+// occurrence of a field and value of its array, e.g. "Fields[branch][0][1]".
+// For fields with several values, "multi_value" chooses the "first" (the
+// default), the "last", all values "joined" with a "separator" (default ","),
+// or "fan_out" to write the message to the partition for each value.
+//
+// To guard against runaway cardinality, a dimension may set
+// "max_distinct_values". S3SplitFileOutput then replaces any new values beyond
+// that many in each window of time with the "overflow_value" (by default the
+// dimension's "other_value"); see CardinalityGuard.
+//
+// Dimension values are sanitized for use in S3 paths by default, which can't
+// be reversed. Setting the schema's "encoding" to "percent" or "base32" uses
+// a reversible encoding instead (see EncodeDimension), in which case allowed
+// values are compared as-is.
+//
 // Example schema:
 //   {
 //     "version": 1,
 //     "dimensions": [
+//       { "header_name": "Type",          "allowed_values": "telemetry" },
 //       { "field_name": "submissionDate", "allowed_values": {
 //           { "min": "20140120", "max": "20140125" }
 //       },
@@ -189,89 +984,476 @@ func SanitizeDimension(dim string) (cleaned string) {
 //         "allowed_values":
 //           [ "default", "nightly", "aurora", "beta", "release", "esr" ]
 //       },
-//       { "field_name": "appVersion",     "allowed_values": "*" }
+//       { "field_name": "docType",        "allowed_values":
+//           { "not": { "pattern": "^crash" } }
+//       },
+//       { "field_name": "appVersion",     "allowed_values":
+//           { "pattern": "^4[0-9]\\.0" }
+//       },
+//       { "field_name": "appBuildId",     "allowed_values":
+//           { "min": "20140101000000", "type": "numeric" }
+//       }
 //     ]
 //   }
 func LoadSchema(schemaFileName string) (schema Schema, err error) {
+	schemaBytes, err := ioutil.ReadFile(schemaFileName)
+	if err != nil {
+		return
+	}
+	return ParseSchema(schemaFileName, schemaBytes)
+}
+
+// Keys that may appear at the top level of a schema.
+var schemaKeys = map[string]struct{}{
+	"version":           struct{}{},
+	"dimensions":        struct{}{},
+	"quarantine_prefix": struct{}{},
+	"encoding":          struct{}{},
+}
+
+// Keys that may appear in each dimension of a schema.
+var schemaDimensionKeys = map[string]struct{}{
+	"field_name":          struct{}{},
+	"header_name":         struct{}{},
+	"allowed_values":      struct{}{},
+	"transform":           struct{}{},
+	"other_value":         struct{}{},
+	"missing_value":       struct{}{},
+	"on_other":            struct{}{},
+	"on_missing":          struct{}{},
+	"hash_of":             struct{}{},
+	"buckets":             struct{}{},
+	"derived":             struct{}{},
+	"format":              struct{}{},
+	"granularity":         struct{}{},
+	"max_distinct_values": struct{}{},
+	"overflow_value":      struct{}{},
+	"multi_value":         struct{}{},
+	"separator":           struct{}{},
+}
+
+// Keys that may appear in a dimension's transform.
+var schemaTransformKeys = map[string]struct{}{
+	"default":    struct{}{},
+	"lowercase":  struct{}{},
+	"aliases":    struct{}{},
+	"max_length": struct{}{},
+}
+
+// Return the first key (alphabetically) of `m` that isn't in `known`, or "".
+func findUnknownKey(m map[string]json.RawMessage, known map[string]struct{}) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, ok := known[k]; !ok {
+			return k
+		}
+	}
+	return ""
+}
+
+// Parse a schema (see LoadSchema) from the given JSON document. The `name` is
+// used to identify the document in any returned *SchemaError.
+func ParseSchema(name string, schemaBytes []byte) (schema Schema, err error) {
 	// Placeholder for parsing JSON
-	type JSchemaDimension struct {
-		Field_name     string
-		Allowed_values interface{}
+	type JSchemaTransform struct {
+		Default    string
+		Lowercase  bool
+		Aliases    map[string]string
+		Max_length int
 	}
 
 	// Placeholder for parsing JSON
-	type JSchema struct {
-		Version    int32
-		Dimensions []JSchemaDimension
+	type JSchemaDimension struct {
+		Field_name          string
+		Header_name         string
+		Allowed_values      interface{}
+		Transform           *JSchemaTransform
+		Other_value         *string
+		Missing_value       *string
+		On_other            string
+		On_missing          string
+		Hash_of             string
+		Buckets             int64
+		Derived             string
+		Format              string
+		Granularity         string
+		Max_distinct_values int
+		Overflow_value      *string
+		Multi_value         string
+		Separator           *string
 	}
 
-	schemaBytes, err := ioutil.ReadFile(schemaFileName)
-	if err != nil {
-		return
+	// Placeholder for parsing JSON
+	type JSchema struct {
+		Version           int32
+		Dimensions        []JSchemaDimension
+		Quarantine_prefix *string
+		Encoding          string
 	}
 
 	var js JSchema
 
 	err = json.Unmarshal(schemaBytes, &js)
 	if err != nil {
-		return
+		return schema, newJSONSchemaError(name, schemaBytes, err, &js)
+	}
+
+	// The document is valid JSON, so now we can locate things in it for
+	// reporting errors.
+	offsets := findSchemaOffsets(schemaBytes)
+	keyError := func(key string, format string, a ...interface{}) error {
+		return newSchemaError(name, schemaBytes, offsets.keys[key], fmt.Sprintf(format, a...))
+	}
+	dimError := func(i int, format string, a ...interface{}) error {
+		offset := 0
+		if i < len(offsets.dimensions) {
+			offset = offsets.dimensions[i]
+		}
+		return newSchemaError(name, schemaBytes, offset, fmt.Sprintf(format, a...))
+	}
+
+	// Look for misspelled or unsupported keys, which would otherwise be
+	// silently ignored.
+	var rawSchema map[string]json.RawMessage
+	var rawDimensions []map[string]json.RawMessage
+	if err = json.Unmarshal(schemaBytes, &rawSchema); err != nil {
+		return schema, newJSONSchemaError(name, schemaBytes, err, &rawSchema)
+	}
+	if k := findUnknownKey(rawSchema, schemaKeys); k != "" {
+		return schema, keyError(k, "Unknown key '%s'", k)
+	}
+	if _, ok := rawSchema["version"]; !ok {
+		return schema, newSchemaError(name, schemaBytes, 0, "Missing 'version'")
+	}
+	if js.Version != 1 && js.Version != 2 {
+		return schema, keyError("version", "Unsupported schema version %d", js.Version)
+	}
+	if _, ok := rawSchema["dimensions"]; !ok {
+		return schema, newSchemaError(name, schemaBytes, 0, "Missing 'dimensions'")
+	}
+	if err = json.Unmarshal(rawSchema["dimensions"], &rawDimensions); err != nil {
+		return schema, keyError("dimensions", "Value of 'dimensions' must be a list of objects")
+	}
+	for i, rd := range rawDimensions {
+		if k := findUnknownKey(rd, schemaDimensionKeys); k != "" {
+			return schema, dimError(i, "Unknown key '%s' in dimension %d", k, i)
+		}
+		if rt, ok := rd["transform"]; ok {
+			var rawTransform map[string]json.RawMessage
+			if err = json.Unmarshal(rt, &rawTransform); err == nil {
+				if k := findUnknownKey(rawTransform, schemaTransformKeys); k != "" {
+					return schema, dimError(i, "Unknown key '%s' in transform for dimension %d", k, i)
+				}
+			}
+		}
 	}
 
 	fields := make([]string, len(js.Dimensions))
 	fieldIndices := map[string]int{}
+	headerIndices := map[string]int{}
 	dims := map[string]DimensionChecker{}
-	schema = Schema{fields, fieldIndices, dims}
+	schema = Schema{
+		Fields:           fields,
+		FieldIndices:     fieldIndices,
+		HeaderIndices:    headerIndices,
+		ComputedIndices:  map[string]int{},
+		Computed:         map[string]ComputedDimension{},
+		Dims:             dims,
+		Transforms:       map[string]*DimensionTransform{},
+		Fallbacks:        map[string]*DimensionFallback{},
+		Limits:           map[string]*DimensionLimit{},
+		QuarantinePrefix: defaultQuarantinePrefix,
+		Encoding:         EncodingSanitize,
+	}
+
+	if js.Quarantine_prefix != nil {
+		schema.QuarantinePrefix = strings.Trim(*js.Quarantine_prefix, "/")
+		if schema.QuarantinePrefix == "" {
+			return schema, keyError("quarantine_prefix", "Value of 'quarantine_prefix' must not be empty")
+		}
+	}
+
+	if js.Encoding != "" {
+		if js.Encoding != EncodingSanitize && js.Encoding != EncodingPercent && js.Encoding != EncodingBase32 {
+			return schema, keyError("encoding", "Unsupported encoding '%s'", js.Encoding)
+		}
+		schema.Encoding = js.Encoding
+	}
 
 	for i, d := range js.Dimensions {
-		schema.Fields[i] = d.Field_name
-		schema.FieldIndices[d.Field_name] = i
-		switch d.Allowed_values.(type) {
-		case string:
-			if d.Allowed_values.(string) == "*" {
-				schema.Dims[d.Field_name] = AnyDimensionChecker{}
+		if d.Derived != "" && d.Field_name == "" && d.Header_name == "" {
+			d.Field_name = d.Derived
+		}
+		if d.Header_name != "" {
+			if d.Field_name != "" {
+				return schema, dimError(i, "Dimension %d must not specify both 'field_name' and 'header_name'", i)
+			}
+			if _, ok := validHeaders[d.Header_name]; !ok {
+				return schema, dimError(i, "Invalid 'header_name' for dimension %d: '%s'", i, d.Header_name)
+			}
+			// From here on, treat the header name as the field name.
+			d.Field_name = d.Header_name
+		} else if d.Field_name == "" {
+			return schema, dimError(i, "Dimension %d must specify a 'field_name' or 'header_name'", i)
+		}
+		if _, ok := schema.Dims[d.Field_name]; ok {
+			return schema, dimError(i, "Duplicate dimension '%s'", d.Field_name)
+		}
+		if d.Hash_of != "" {
+			if d.Header_name != "" {
+				return schema, dimError(i, "Hashed dimension %d must specify a 'field_name'", i)
+			}
+			if d.Buckets <= 0 || d.Buckets > math.MaxUint32 {
+				return schema, dimError(i, "Value of 'buckets' for field '%s' must be a positive integer", d.Field_name)
+			}
+			if d.Allowed_values == nil {
+				d.Allowed_values = "*"
+			}
+		} else if d.Buckets != 0 {
+			return schema, dimError(i, "Value of 'buckets' for field '%s' requires 'hash_of'", d.Field_name)
+		}
+		var timeBucket *TimeBucketDimension
+		if d.Derived != "" {
+			if d.Header_name != "" || d.Hash_of != "" {
+				return schema, dimError(i, "Derived dimension %d must not specify 'header_name' or 'hash_of'", i)
+			}
+			if _, ok := validHeaders[d.Derived]; ok && d.Derived != "Timestamp" {
+				return schema, dimError(i, "Cannot derive a time for field '%s' from the %s header", d.Field_name, d.Derived)
+			}
+			timeBucket = &TimeBucketDimension{Source: d.Derived, Layout: d.Format}
+			if timeBucket.Layout == "" {
+				timeBucket.Layout = timestampDimensionLayout
+			}
+			if d.Granularity != "" {
+				timeBucket.Granularity, err = time.ParseDuration(d.Granularity)
+				if err != nil || timeBucket.Granularity <= 0 {
+					return schema, dimError(i, "Invalid 'granularity' for field '%s': '%s'", d.Field_name, d.Granularity)
+				}
+			}
+			if d.Allowed_values == nil {
+				d.Allowed_values = "*"
+			}
+		} else if d.Format != "" || d.Granularity != "" {
+			return schema, dimError(i, "Values of 'format' and 'granularity' for field '%s' require 'derived'", d.Field_name)
+		}
+		var selector *FieldSelector
+		if d.Header_name == "" && d.Hash_of == "" && timeBucket == nil {
+			if selector, err = ParseFieldSelector(d.Field_name); err != nil {
+				return schema, dimError(i, "%s", err)
+			}
+			if d.Multi_value != "" {
+				if selector.ArrayIndex >= 0 {
+					return schema, dimError(i, "Field '%s' selects a single value, so must not specify 'multi_value'", d.Field_name)
+				}
+				switch d.Multi_value {
+				case MultiValueFirst, MultiValueLast, MultiValueJoined, MultiValueFanOut:
+					selector.MultiValue = d.Multi_value
+				default:
+					return schema, dimError(i, "Invalid 'multi_value' for field '%s': '%s'", d.Field_name, d.Multi_value)
+				}
+			}
+			if d.Separator != nil {
+				if selector.MultiValue != MultiValueJoined {
+					return schema, dimError(i, "Value of 'separator' for field '%s' requires 'multi_value' of 'joined'", d.Field_name)
+				}
+				selector.Separator = *d.Separator
 			} else {
-				schema.Dims[d.Field_name] = NewListDimensionChecker([]string{d.Allowed_values.(string)})
-			}
-		case []interface{}:
-			allowed := make([]string, len(d.Allowed_values.([]interface{})))
-			for i, v := range d.Allowed_values.([]interface{}) {
-				allowedValue, ok := v.(string)
-				if !ok {
-					return schema, fmt.Errorf("Entries in 'allowed_values' for field '%s' must be strings", d.Field_name)
+				selector.Separator = ","
+			}
+			if selector.Name == d.Field_name && selector.MultiValue == MultiValueFirst {
+				// A plain field, which doesn't need a selector.
+				selector = nil
+			}
+		} else if d.Multi_value != "" || d.Separator != nil {
+			return schema, dimError(i, "Values of 'multi_value' and 'separator' for field '%s' require a message field", d.Field_name)
+		}
+		if d.Header_name != "" {
+			schema.HeaderIndices[d.Header_name] = i
+		} else if selector != nil {
+			schema.ComputedIndices[d.Field_name] = i
+			schema.Computed[d.Field_name] = selector
+		} else if d.Hash_of != "" {
+			schema.ComputedIndices[d.Field_name] = i
+			schema.Computed[d.Field_name] = &HashDimension{d.Hash_of, uint32(d.Buckets)}
+		} else if timeBucket != nil {
+			schema.ComputedIndices[d.Field_name] = i
+			schema.Computed[d.Field_name] = timeBucket
+		} else {
+			schema.FieldIndices[d.Field_name] = i
+		}
+		schema.Fields[i] = d.Field_name
+		if d.Transform != nil {
+			if js.Version < 2 {
+				return schema, dimError(i, "Transform for field '%s' requires schema version 2", d.Field_name)
+			}
+			if d.Transform.Max_length < 0 {
+				return schema, dimError(i, "Value of 'max_length' for field '%s' must not be negative", d.Field_name)
+			}
+			schema.Transforms[d.Field_name] = &DimensionTransform{
+				Default:   d.Transform.Default,
+				Lowercase: d.Transform.Lowercase,
+				Aliases:   d.Transform.Aliases,
+				MaxLength: d.Transform.Max_length,
+			}
+		}
+		if d.Other_value != nil || d.Missing_value != nil || d.On_other != "" || d.On_missing != "" {
+			fallback := defaultFallback
+			if d.Other_value != nil {
+				fallback.OtherValue = *d.Other_value
+			}
+			if d.Missing_value != nil {
+				fallback.MissingValue = *d.Missing_value
+			}
+			if d.On_other != "" {
+				fallback.OnOther = d.On_other
+			}
+			if d.On_missing != "" {
+				fallback.OnMissing = d.On_missing
+			}
+			for _, action := range []string{fallback.OnOther, fallback.OnMissing} {
+				if action != FallbackReplace && action != FallbackDrop && action != FallbackQuarantine {
+					return schema, dimError(i, "Invalid fallback action for field '%s': '%s'", d.Field_name, action)
 				}
-				allowed[i] = allowedValue
 			}
-			schema.Dims[d.Field_name] = NewListDimensionChecker(allowed)
-		case map[string]interface{}:
-			vrange := d.Allowed_values.(map[string]interface{})
+			if fallback.OtherValue == "" || fallback.MissingValue == "" {
+				return schema, dimError(i, "Fallback values for field '%s' must not be empty", d.Field_name)
+			}
+			schema.Fallbacks[d.Field_name] = &fallback
+		}
+		if d.Max_distinct_values < 0 {
+			return schema, dimError(i, "Value of 'max_distinct_values' for field '%s' must not be negative", d.Field_name)
+		}
+		if d.Max_distinct_values > 0 {
+			limit := &DimensionLimit{MaxDistinctValues: d.Max_distinct_values}
+			if d.Overflow_value != nil {
+				if *d.Overflow_value == "" {
+					return schema, dimError(i, "Value of 'overflow_value' for field '%s' must not be empty", d.Field_name)
+				}
+				limit.OverflowValue = *d.Overflow_value
+			}
+			schema.Limits[d.Field_name] = limit
+		} else if d.Overflow_value != nil {
+			return schema, dimError(i, "Value of 'overflow_value' for field '%s' requires 'max_distinct_values'", d.Field_name)
+		}
+		checker, err := newDimensionChecker(d.Allowed_values, schema.Encoding != EncodingSanitize)
+		if err != nil {
+			return schema, dimError(i, "Invalid 'allowed_values' for field '%s': %s", d.Field_name, err)
+		}
+		schema.Dims[d.Field_name] = checker
+	}
+	return
+}
 
-			vMin, okMin := vrange["min"]
-			vMax, okMax := vrange["max"]
+// Create a DimensionChecker from the (parsed JSON) `allowed_values` of a
+// schema dimension.
+func newDimensionChecker(allowedValues interface{}, exact bool) (DimensionChecker, error) {
+	switch av := allowedValues.(type) {
+	case string:
+		if av == "*" {
+			return AnyDimensionChecker{}, nil
+		}
+		if exact {
+			return NewExactListDimensionChecker([]string{av}), nil
+		}
+		return NewListDimensionChecker([]string{av}), nil
+	case []interface{}:
+		if len(av) == 0 {
+			return nil, fmt.Errorf("List must not be empty")
+		}
+		allowed := make([]string, len(av))
+		for i, v := range av {
+			allowedValue, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("List entries must be strings (found %s)", jsonTypeName(v))
+			}
+			allowed[i] = allowedValue
+		}
+		if exact {
+			return NewExactListDimensionChecker(allowed), nil
+		}
+		return NewListDimensionChecker(allowed), nil
+	case map[string]interface{}:
+		if vNot, okNot := av["not"]; okNot {
+			if len(av) > 1 {
+				return nil, fmt.Errorf("Exclusion ('not') must not be combined with other keys")
+			}
+			if vNot == "*" {
+				return nil, fmt.Errorf("Exclusion of '*' would not allow any values")
+			}
+			excluded, err := newDimensionChecker(vNot, exact)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid exclusion ('not'): %s", err)
+			}
+			return NewNotDimensionChecker(excluded), nil
+		}
+
+		if vPattern, okPattern := av["pattern"]; okPattern {
+			if len(av) > 1 {
+				return nil, fmt.Errorf("Pattern must not be combined with other keys")
+			}
+			patternStr, ok := vPattern.(string)
+			if !ok {
+				return nil, fmt.Errorf("Value of 'pattern' must be a string (found %s)", jsonTypeName(vPattern))
+			}
+			checker, err := NewPatternDimensionChecker(patternStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid 'pattern': %s", err)
+			}
+			return checker, nil
+		}
 
-			if !okMin && !okMax {
-				return schema, fmt.Errorf("Range for field '%s' must have at least one of 'min' or 'max'", d.Field_name)
+		for k := range av {
+			if k != "min" && k != "max" && k != "type" {
+				return nil, fmt.Errorf("Unknown key '%s' in range", k)
 			}
+		}
 
-			ok := false
-			minStr := ""
-			if okMin {
-				minStr, ok = vMin.(string)
-				if !ok {
-					return schema, fmt.Errorf("Value of 'min' for field '%s' must be a string", d.Field_name)
-				}
+		vMin, okMin := av["min"]
+		vMax, okMax := av["max"]
+
+		if !okMin && !okMax {
+			return nil, fmt.Errorf("Range must have at least one of 'min' or 'max'")
+		}
+
+		ok := false
+		minStr := ""
+		if okMin {
+			minStr, ok = vMin.(string)
+			if !ok {
+				return nil, fmt.Errorf("Value of 'min' must be a string (found %s)", jsonTypeName(vMin))
 			}
+		}
 
-			maxStr := ""
-			if okMax {
-				maxStr, ok = vMax.(string)
-				if !ok {
-					return schema, fmt.Errorf("Value of 'max' for field '%s' must be a string (it was %+v)", d.Field_name, vMax)
-				}
+		maxStr := ""
+		if okMax {
+			maxStr, ok = vMax.(string)
+			if !ok {
+				return nil, fmt.Errorf("Value of 'max' must be a string (found %s)", jsonTypeName(vMax))
+			}
+		}
+		typeStr := ""
+		if vType, okType := av["type"]; okType {
+			typeStr, ok = vType.(string)
+			if !ok {
+				return nil, fmt.Errorf("Value of 'type' must be a string (found %s)", jsonTypeName(vType))
 			}
-			schema.Dims[d.Field_name] = RangeDimensionChecker{minStr, maxStr}
 		}
+		checker, err := NewRangeDimensionChecker(minStr, maxStr, typeStr)
+		if err != nil {
+			return nil, err
+		}
+		if checker.min != "" && checker.max != "" && !checker.IsAllowed(checker.min) {
+			return nil, fmt.Errorf("Range is empty: '%s' is greater than '%s'", checker.min, checker.max)
+		}
+		return checker, nil
+	case nil:
+		return nil, fmt.Errorf("Value is required")
 	}
-	return
+	return nil, fmt.Errorf("Value must be a string, a list of strings or an object (found %s)", jsonTypeName(allowedValues))
 }
 
 var suffixes = [...]string{"", "K", "M", "G", "T", "P"}
@@ -302,13 +1484,114 @@ const fileBatchSize = 300
 type S3ListResult struct {
 	Key s3.Key
 	Err error
+
+	// The prefix that could not be listed, if Err is a listing error. Keys
+	// under it were not visited.
+	Prefix string
+}
+
+// Number of times to try each S3 List request before giving up on a prefix.
+const listAttempts = 5
+
+// Delay before the first retry of a List request. It doubles on each retry,
+// up to listRetryMaxDelay.
+const listRetryDelay = 200 * time.Millisecond
+const listRetryMaxDelay = 10 * time.Second
+
+// Get how long to wait before retrying a List request that has failed
+// `attempt` times. Half of the delay is random, so that concurrent listers
+// don't all retry at once.
+func listBackoff(attempt int) time.Duration {
+	delay := listRetryDelay
+	for i := 1; i < attempt && delay < listRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > listRetryMaxDelay {
+		delay = listRetryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Check whether a List request that failed with the given error is worth
+// retrying. S3 errors other than server errors and throttling are permanent.
+func isRetryableListError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.StatusCode >= 500 || s3err.StatusCode == 429 || s3err.Code == "SlowDown"
+	}
+	// Anything else is a network error or the like.
+	return true
+}
+
+// The part of an S3 bucket used to list its contents.
+type bucketLister interface {
+	List(prefix, delim, marker string, max int) (result *s3.ListResp, err error)
+}
+
+// List a page of the given bucket, retrying failed requests. Gives up
+// without retrying any further once the context is cancelled.
+func listWithRetry(ctx context.Context, bucket bucketLister, prefix, marker string) (response *s3.ListResp, err error) {
+	for attempt := 1; ; attempt++ {
+		response, err = bucket.List(prefix, "/", marker, listBatchSize)
+		if err == nil || attempt >= listAttempts || !isRetryableListError(err) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(listBackoff(attempt)):
+		}
+	}
+}
+
+// Send a result unless the context is cancelled first. Returns false if it
+// wasn't sent.
+func sendListResult(ctx context.Context, kc chan S3ListResult, r S3ListResult) bool {
+	select {
+	case kc <- r:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // List the contents of the given bucket, sending matching filenames to a
 // channel which can be read by the caller.
 func S3Iterator(bucket *s3.Bucket, prefix string, schema Schema) <-chan S3ListResult {
+	return S3IteratorContext(context.Background(), bucket, prefix, schema)
+}
+
+// List the contents of the given bucket like S3Iterator until the context is
+// cancelled. Once it is, no more List requests are made and the channel is
+// closed as soon as any in-flight request returns.
+func S3IteratorContext(ctx context.Context, bucket *s3.Bucket, prefix string, schema Schema) <-chan S3ListResult {
+	return S3CachedIterator(ctx, bucket, prefix, schema, 1, nil)
+}
+
+// List the contents of the given bucket like S3Iterator, but with up to
+// `concurrency` List requests in flight at once. Keys are not returned in
+// order. A concurrency of 1 or less is the same as S3Iterator.
+func S3ParallelIterator(bucket *s3.Bucket, prefix string, schema Schema, concurrency int) <-chan S3ListResult {
+	return S3ParallelIteratorContext(context.Background(), bucket, prefix, schema, concurrency)
+}
+
+// List the contents of the given bucket like S3ParallelIterator until the
+// context is cancelled, as with S3IteratorContext.
+func S3ParallelIteratorContext(ctx context.Context, bucket *s3.Bucket, prefix string, schema Schema, concurrency int) <-chan S3ListResult {
+	return S3CachedIterator(ctx, bucket, prefix, schema, concurrency, nil)
+}
+
+// List the contents of the given bucket like S3ParallelIteratorContext, taking
+// the keys of leaf prefixes from the cache where possible and recording the
+// rest in it. The cache may be nil. Callers should Save the cache once the
+// channel is closed.
+func S3CachedIterator(ctx context.Context, bucket *s3.Bucket, prefix string, schema Schema, concurrency int, cache *ListingCache) <-chan S3ListResult {
 	keyChannel := make(chan S3ListResult, listBatchSize)
-	go FilterS3(bucket, prefix, 0, schema, keyChannel)
+	l := &s3Lister{bucket, schema, cache, time.Now().UTC()}
+	if concurrency <= 1 {
+		go l.filter(ctx, prefix, 0, keyChannel)
+	} else {
+		go l.filterParallel(ctx, prefix, concurrency, keyChannel)
+	}
 	return keyChannel
 }
 
@@ -317,6 +1600,161 @@ func S3Iterator(bucket *s3.Bucket, prefix string, schema Schema) <-chan S3ListRe
 // indicates how far down the tree we are, and is used to determine which schema
 // field we use for filtering.
 func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, kc chan S3ListResult) {
+	FilterS3Context(context.Background(), bucket, prefix, level, schema, kc)
+}
+
+// Descend into an S3 directory tree like FilterS3, stopping once the context
+// is cancelled.
+func FilterS3Context(ctx context.Context, bucket *s3.Bucket, prefix string, level int, schema Schema, kc chan S3ListResult) {
+	l := &s3Lister{bucket: bucket, schema: schema}
+	l.filter(ctx, prefix, level, kc)
+}
+
+// Descend into an S3 directory tree like FilterS3Context, using a pool of
+// `concurrency` workers to list prefixes. The channel is closed once every
+// prefix has been listed, or the context has been cancelled.
+func FilterS3Parallel(ctx context.Context, bucket *s3.Bucket, prefix string, schema Schema, concurrency int, kc chan S3ListResult) {
+	l := &s3Lister{bucket: bucket, schema: schema}
+	l.filterParallel(ctx, prefix, concurrency, kc)
+}
+
+// Everything needed to list a tree.
+type s3Lister struct {
+	bucket bucketLister
+	schema Schema
+	cache  *ListingCache
+	// When the listing started, which decides what the cache lists again.
+	now time.Time
+}
+
+func (l *s3Lister) filter(ctx context.Context, prefix string, level int, kc chan S3ListResult) {
+	l.listLevel(ctx, prefix, level, kc, func(pf string) {
+		l.filter(ctx, pf, level+1, kc)
+	})
+
+	if level == 0 {
+		// We traverse the tree in depth-first order, so once we've reached the
+		// end at the root (level 0), we know we're done.
+		close(kc)
+	}
+	return
+}
+
+// A prefix waiting to be listed by filterParallel.
+type listTask struct {
+	prefix string
+	level  int
+}
+
+func (l *s3Lister) filterParallel(ctx context.Context, prefix string, concurrency int, kc chan S3ListResult) {
+	var (
+		lock    sync.Mutex
+		cond    = sync.NewCond(&lock)
+		tasks   = []listTask{{prefix, 0}}
+		pending = 1 // Tasks queued or being listed.
+		wg      sync.WaitGroup
+	)
+
+	worker := func() {
+		defer wg.Done()
+		for {
+			lock.Lock()
+			for len(tasks) == 0 && pending > 0 {
+				cond.Wait()
+			}
+			if ctx.Err() != nil {
+				// Cancelled, so forget about anything still to be listed.
+				pending -= len(tasks)
+				tasks = nil
+			}
+			if pending == 0 {
+				cond.Broadcast()
+				lock.Unlock()
+				return
+			}
+			if len(tasks) == 0 {
+				// Other workers are still listing.
+				lock.Unlock()
+				continue
+			}
+			// Take the most recently queued task, so that we descend towards
+			// the keys as soon as possible rather than listing the tree one
+			// level at a time.
+			t := tasks[len(tasks)-1]
+			tasks = tasks[:len(tasks)-1]
+			lock.Unlock()
+
+			l.listLevel(ctx, t.prefix, t.level, kc, func(pf string) {
+				lock.Lock()
+				tasks = append(tasks, listTask{pf, t.level + 1})
+				pending++
+				lock.Unlock()
+				cond.Signal()
+			})
+
+			lock.Lock()
+			pending--
+			if pending == 0 {
+				// Nothing left to list, so wake up the idle workers to exit.
+				cond.Broadcast()
+			}
+			lock.Unlock()
+		}
+	}
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go worker()
+	}
+	wg.Wait()
+	close(kc)
+}
+
+// List a single level of an S3 directory tree. Keys are sent on the given
+// channel if we are past all the schema's dimensions, otherwise `descend` is
+// called for each allowed prefix. Returns early if the context is cancelled.
+func (l *s3Lister) listLevel(ctx context.Context, prefix string, level int, kc chan S3ListResult, descend func(string)) {
+	bucket, schema := l.bucket, l.schema
+
+	if level < len(schema.Fields) {
+		if values, ok := schema.Dims[schema.Fields[level]].ListValues(); ok {
+			// If we have a list of allowed values, check each one directly
+			// instead of listing the entire bucket. This is MUCH faster in the
+			// case of high-cardinality dimensions (more than 1000 unique values
+			// for the dimension), and needs no List request at all.
+			for _, v := range values {
+				if ctx.Err() != nil {
+					return
+				}
+				descend(fmt.Sprintf("%s%s/", prefix, schema.EncodeDimension(v)))
+			}
+			return
+		}
+	}
+
+	// The cache may already know the keys, or the prefixes at this level,
+	// of a cold date.
+	var cache *ListingCache
+	var listed []s3.Key
+	var listedPrefixes []string
+	if l.cache != nil && level >= len(schema.Fields) {
+		if keys, ok := l.cache.Lookup(prefix, l.now); ok {
+			for _, k := range keys {
+				if !sendListResult(ctx, kc, S3ListResult{Key: k}) {
+					return
+				}
+			}
+			return
+		}
+		cache = l.cache
+	} else if l.cache != nil {
+		if prefixes, ok := l.cache.LookupPrefixes(prefix, l.now); ok {
+			l.descendAllowed(ctx, prefix, level, prefixes, descend)
+			return
+		}
+		cache = l.cache
+	}
+
 	// Update the marker as we encounter keys / prefixes. If a response is
 	// truncated, the next `List` request will start from the next item after
 	// the marker.
@@ -324,14 +1762,31 @@ func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, kc cha
 
 	// Keep listing if the response is incomplete (there are more than
 	// `listBatchSize` entries or prefixes)
+	// If the values at this level share a common literal prefix, we only need
+	// to list the entries starting with it.
+	listPrefix := prefix
+	if level < len(schema.Fields) {
+		if pc, ok := schema.Dims[schema.Fields[level]].(PrefixDimensionChecker); ok {
+			listPrefix += schema.encodeListPrefix(pc.ListPrefix())
+		}
+		if listPrefix != prefix {
+			// Only some of the prefixes will be listed, while the cache
+			// is shared by schemas allowing other values.
+			cache = nil
+		}
+	}
+
 	done := false
 	for !done {
-		response, err := bucket.List(prefix, "/", marker, listBatchSize)
+		if ctx.Err() != nil {
+			return
+		}
+		response, err := listWithRetry(ctx, bucket, listPrefix, marker)
 		if err != nil {
-			fmt.Printf("Error listing: %s\n", err)
-			// TODO: retry?
-			kc <- S3ListResult{s3.Key{}, err}
-			break
+			if ctx.Err() == nil {
+				sendListResult(ctx, kc, S3ListResult{Err: err, Prefix: prefix})
+			}
+			return
 		}
 
 		if !response.IsTruncated {
@@ -345,50 +1800,47 @@ func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, kc cha
 			// specified schema is correct/complete.
 			for _, k := range response.Contents {
 				marker = k.Key
-				kc <- S3ListResult{k, nil}
+				if !sendListResult(ctx, kc, S3ListResult{Key: k}) {
+					return
+				}
+			}
+			if cache != nil {
+				listed = append(listed, response.Contents...)
 			}
 		} else {
-			// We are still looking at prefixes. Recursively list each one that
-			// matches the specified schema's allowed values.
-			field := schema.Dims[schema.Fields[level]]
-
-			if values, ok := field.ListValues(); ok {
-				// If we have a list of allowed values, check each one directly
-				// instead of listing the entire bucket. This is MUCH faster in the
-				// case of high-cardinality dimensions (more than 1000 unique values
-				// for the dimension).
-				for _, v := range values {
-					newPrefix := fmt.Sprintf("%s%s/", prefix, v)
-					marker = newPrefix
-					FilterS3(bucket, newPrefix, level+1, schema, kc)
-				}
-				done = true
-			} else {
-				// We have a Range or All type dimension, so list all values and
-				// check if each one is allowed.
-				for _, pf := range response.CommonPrefixes {
-					// Get just the last piece of the prefix to check it as a
-					// dimension. If we have '/foo/bar/baz', we just want 'baz'.
-					stripped := pf[len(prefix) : len(pf)-1]
-					allowed := field.IsAllowed(stripped)
-					marker = pf
-					if allowed {
-						FilterS3(bucket, pf, level+1, schema, kc)
-					}
-				}
+			// We are still looking at prefixes of a Range or All type
+			// dimension, so list all values and check if each one is allowed.
+			if n := len(response.CommonPrefixes); n > 0 {
+				marker = response.CommonPrefixes[n-1]
+			}
+			l.descendAllowed(ctx, prefix, level, response.CommonPrefixes, descend)
+			if cache != nil {
+				listedPrefixes = append(listedPrefixes, response.CommonPrefixes...)
 			}
 		}
 	}
 
-	if level == 0 {
-		// We traverse the tree in depth-first order, so once we've reached the
-		// end at the root (level 0), we know we're done.
-		// Note that things could be made faster by parallelizing the recursive
-		// listing, but we would need some other mechanism to know when to close
-		// the channel?
-		close(kc)
+	// We only get here if the whole prefix was listed.
+	if cache != nil && level >= len(schema.Fields) {
+		cache.Store(prefix, listed)
+	} else if cache != nil {
+		cache.StorePrefixes(prefix, listedPrefixes)
+	}
+}
+
+// Descend into each of the given prefixes under `prefix` whose value for the
+// dimension at this level is allowed.
+func (l *s3Lister) descendAllowed(ctx context.Context, prefix string, level int, prefixes []string, descend func(string)) {
+	field := l.schema.Dims[l.schema.Fields[level]]
+	for _, pf := range prefixes {
+		// Get just the last piece of the prefix to check it as a
+		// dimension. If we have '/foo/bar/baz', we just want 'baz'.
+		stripped := pf[len(prefix) : len(pf)-1]
+		value, err := l.schema.DecodeDimension(stripped)
+		if err == nil && field.IsAllowed(value) && ctx.Err() == nil {
+			descend(pf)
+		}
 	}
-	return
 }
 
 // Encapsulates a single record within an S3 file, allowing detection of errors
@@ -399,18 +1851,71 @@ type S3Record struct {
 	BytesRead int
 	Record    []byte
 	Err       error
+
+	// How the file is compressed, if at all. Offset and BytesRead refer to
+	// the uncompressed data, and so can't be used in a Range request on a
+	// compressed file, though they can be passed back to ReadS3File.
+	Compression string
 }
 
 // List the contents of the given bucket, sending matching filenames to a
 // channel which can be read by the caller.
 func S3FileIterator(bucket *s3.Bucket, s3Key string, offset uint64) <-chan S3Record {
+	return S3FileIteratorContext(context.Background(), bucket, s3Key, offset)
+}
+
+// Read the records of an S3 file like S3FileIterator until the context is
+// cancelled, at which point the read is abandoned and the channel closed.
+func S3FileIteratorContext(ctx context.Context, bucket *s3.Bucket, s3Key string, offset uint64) <-chan S3Record {
 	recordChannel := make(chan S3Record, fileBatchSize)
-	go ReadS3File(bucket, s3Key, offset, recordChannel)
+	go ReadS3FileContext(ctx, bucket, s3Key, offset, recordChannel)
 	return recordChannel
 }
 
-func makeS3Record(s3Key string, offset uint64, bytesRead int, data []byte, err error) (result S3Record) {
-	r := S3Record{}
+// Read the records of an S3 file like S3FileIteratorContext, using the given
+// splitter (see NewSplitter) to find them. The splitter must not be shared
+// with another reader.
+func S3FileIteratorWithSplitter(ctx context.Context, bucket *s3.Bucket, s3Key string, offset uint64, splitter Splitter) <-chan S3Record {
+	recordChannel := make(chan S3Record, fileBatchSize)
+	go ReadS3FileWithSplitter(ctx, bucket, s3Key, offset, splitter, recordChannel)
+	return recordChannel
+}
+
+// Send a record unless the context is cancelled first. Returns false if it
+// wasn't sent.
+func sendRecord(ctx context.Context, recordChan chan S3Record, r S3Record) bool {
+	select {
+	case recordChan <- r:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// The error of a record larger than message.MAX_RECORD_SIZE. The record is
+// skipped, and reading it again would fail the same way, so it's not worth
+// retrying.
+type RecordTooLargeError struct {
+	MaxSize int
+}
+
+func (e RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record exceeded MAX_RECORD_SIZE %d", e.MaxSize)
+}
+
+// The error sent with the bytes left over at the end of a Heka framed stream,
+// which are a truncated message. The bytes are discarded, and reading the file
+// again would find the same, so it's not worth retrying.
+type TruncatedRecordError struct {
+	Bytes int
+}
+
+func (e TruncatedRecordError) Error() string {
+	return fmt.Sprintf("%d bytes of a truncated record left at EOF", e.Bytes)
+}
+
+func makeS3Record(s3Key string, compression string, offset uint64, bytesRead int, data []byte, err error) (result S3Record) {
+	r := S3Record{Compression: compression}
 	r.BytesRead = bytesRead
 	r.Err = err
 	r.Key = s3Key
@@ -420,83 +1925,101 @@ func makeS3Record(s3Key string, offset uint64, bytesRead int, data []byte, err e
 	return r
 }
 
-// TODO: duplicated from heka-cat
-func makeSplitterRunner() (SplitterRunner, error) {
-	splitter := &HekaFramingSplitter{}
-	config := splitter.ConfigStruct()
-	err := splitter.Init(config)
-	if err != nil {
-		return nil, fmt.Errorf("Error initializing HekaFramingSplitter: %s", err)
-	}
-	srConfig := CommonSplitterConfig{}
-	sRunner := NewSplitterRunner("HekaFramingSplitter", splitter, srConfig)
-	return sRunner, nil
+// Read the records of an S3 file, starting from the given offset, sending them
+// on the channel. Compressed files are decompressed as they are read.
+func ReadS3File(bucket *s3.Bucket, s3Key string, s3Offset uint64, recordChan chan S3Record) {
+	ReadS3FileContext(context.Background(), bucket, s3Key, s3Offset, recordChan)
 }
 
-// Callers must call Close() on rc.
-func getS3Reader(bucket *s3.Bucket, s3Key string, offset uint64) (rc io.ReadCloser, err error) {
-	if offset == 0 {
-		rc, err = bucket.GetReader(s3Key)
+// Read the records of an S3 file like ReadS3File, stopping once the context
+// is cancelled. A read that is blocked on S3 is interrupted by closing the
+// underlying connection.
+func ReadS3FileContext(ctx context.Context, bucket *s3.Bucket, s3Key string, s3Offset uint64, recordChan chan S3Record) {
+	splitter, err := NewSplitter(SplitterHekaFraming, "")
+	if err != nil {
+		sendRecord(ctx, recordChan, S3Record{Key: s3Key, Record: []byte{}, Err: err})
+		close(recordChan)
 		return
 	}
-
-	headers := map[string][]string{
-		"Range": []string{fmt.Sprintf("bytes=%d-", offset)},
-	}
-
-	resp, err := bucket.GetResponseWithHeaders(s3Key, headers)
-
-	if resp != nil {
-		rc = resp.Body
-	}
-	return
+	ReadS3FileWithSplitter(ctx, bucket, s3Key, s3Offset, splitter, recordChan)
 }
 
-func ReadS3File(bucket *s3.Bucket, s3Key string, s3Offset uint64, recordChan chan S3Record) {
+// Read the records of an S3 file like ReadS3FileContext, using the given
+// splitter to find them. Unlike a Heka framed stream, where leftover bytes are
+// a truncated message and are discarded with a TruncatedRecordError, any data
+// after the last delimiter is sent as the final record.
+func ReadS3FileWithSplitter(ctx context.Context, bucket *s3.Bucket, s3Key string, s3Offset uint64, splitter Splitter, recordChan chan S3Record) {
 	defer close(recordChan)
 
-	sRunner, err := makeSplitterRunner()
-	if err != nil {
-		recordChan <- S3Record{s3Key, 0, 0, []byte{}, err}
+	if ctx.Err() != nil {
 		return
 	}
-
-	reader, err := getS3Reader(bucket, s3Key, s3Offset)
-	if reader != nil {
-		defer reader.Close()
-	}
+	reader, compression, err := openS3Object(bucket, s3Key, s3Offset)
 	if err != nil {
-		recordChan <- S3Record{s3Key, 0, 0, []byte{}, err}
+		sendRecord(ctx, recordChan, S3Record{Key: s3Key, Record: []byte{}, Err: err, Compression: compression})
 		return
 	}
+	defer reader.Close()
+	readRecords(ctx, reader, s3Key, compression, s3Offset, splitter, recordChan)
+}
+
+// Send the records of an open S3 object like splitRecords, closing the reader
+// to interrupt a blocked read if the context is cancelled.
+func readRecords(ctx context.Context, reader io.ReadCloser, s3Key string, compression string, s3Offset uint64, splitter Splitter, recordChan chan S3Record) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			reader.Close()
+		case <-finished:
+		}
+	}()
+
+	splitRecords(ctx, reader, s3Key, compression, s3Offset, splitter, recordChan)
+}
+
+// Send the records found in a stream by the splitter, the first of which
+// starts at the given offset in the S3 file.
+func splitRecords(ctx context.Context, reader io.Reader, s3Key string, compression string, s3Offset uint64, splitter Splitter, recordChan chan S3Record) {
+	sRunner := NewSplitterRunner("S3FileSplitter", splitter, CommonSplitterConfig{})
+	framed := isHekaFraming(splitter)
 
 	size := s3Offset
 	offset := s3Offset
 
+	var remaining []byte
 	done := false
 	for !done {
 		n, record, err := sRunner.GetRecordFromStream(reader)
+		if ctx.Err() != nil {
+			// Any error is most likely from closing the reader.
+			return
+		}
 		offset = size
 		size += uint64(n)
 
 		if err != nil {
 			if err == io.EOF {
-				lenRemaining := len(sRunner.GetRemainingData())
-				if lenRemaining > 0 {
+				remaining = sRunner.GetRemainingData()
+				if framed && len(remaining) > 0 {
 					// There was a partial message at the end of the stream.
 					// Discard the leftover bytes.
-					fmt.Printf("At EOF, len(remaining data) was %d\n", lenRemaining)
+					sendRecord(ctx, recordChan, makeS3Record(s3Key, compression, size, len(remaining), nil, TruncatedRecordError{len(remaining)}))
+					remaining = nil
 				}
 
 				done = true
 			} else if err == io.ErrShortBuffer {
-				recordChan <- makeS3Record(s3Key, offset, n, record, fmt.Errorf("record exceeded MAX_RECORD_SIZE %d", message.MAX_RECORD_SIZE))
+				if !sendRecord(ctx, recordChan, makeS3Record(s3Key, compression, offset, n, record, RecordTooLargeError{int(message.MAX_RECORD_SIZE)})) {
+					return
+				}
 				continue
 			} else {
 				// Some other kind of error occurred.
 				// Retry behaviour should be handled externally, we can restart
 				// from the last-good location using the s3Offset parameter.
-				recordChan <- makeS3Record(s3Key, offset, n, record, err)
+				sendRecord(ctx, recordChan, makeS3Record(s3Key, compression, offset, n, record, err))
 				done = true
 				continue
 			}
@@ -508,9 +2031,15 @@ func ReadS3File(bucket *s3.Bucket, s3Key string, s3Offset uint64, recordChan cha
 			continue
 		}
 
-		recordChan <- makeS3Record(s3Key, offset, n, record, err)
+		if !sendRecord(ctx, recordChan, makeS3Record(s3Key, compression, offset, n, record, err)) {
+			return
+		}
 	}
 
+	if len(remaining) > 0 {
+		// The last record had no delimiter after it.
+		sendRecord(ctx, recordChan, makeS3Record(s3Key, compression, size, len(remaining), remaining, nil))
+	}
 	return
 }
 
@@ -7,10 +7,24 @@
 package s3splitfile
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 func testFieldVal(c gs.Context, schema Schema, field string, actual string, expected string) {
@@ -19,6 +33,103 @@ func testFieldVal(c gs.Context, schema Schema, field string, actual string, expe
 	c.Expect(sVal, gs.Equals, expected)
 }
 
+// A bucket holding the given keys, which can be listed without S3. It records
+// the prefixes it's asked to list.
+type fakeBucket struct {
+	keys   []string
+	lock   sync.Mutex
+	listed []string
+
+	// The most entries returned by each List, if not zero.
+	pageSize int
+	// Called with the prefix before each List, if set.
+	onList func(prefix string)
+	// Returned by every List, if set.
+	err error
+}
+
+func (b *fakeBucket) List(prefix, delim, marker string, max int) (*s3.ListResp, error) {
+	b.lock.Lock()
+	b.listed = append(b.listed, prefix)
+	b.lock.Unlock()
+	if b.onList != nil {
+		b.onList(prefix)
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.pageSize > 0 {
+		max = b.pageSize
+	}
+
+	keys := append([]string{}, b.keys...)
+	sort.Strings(keys)
+	resp := &s3.ListResp{Prefix: prefix, Delimiter: delim, Marker: marker, MaxKeys: max}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		entry, isPrefix := k, false
+		if i := strings.Index(k[len(prefix):], delim); delim != "" && i >= 0 {
+			entry, isPrefix = k[:len(prefix)+i+len(delim)], true
+		}
+		if entry <= marker || seen[entry] {
+			continue
+		}
+		if len(resp.Contents)+len(resp.CommonPrefixes) == max {
+			resp.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		if isPrefix {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, entry)
+		} else {
+			resp.Contents = append(resp.Contents, s3.Key{Key: k})
+		}
+	}
+	return resp, nil
+}
+
+// Count the List requests made for prefixes starting with the given one.
+func (b *fakeBucket) listCount(prefix string) (n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, p := range b.listed {
+		if strings.HasPrefix(p, prefix) {
+			n++
+		}
+	}
+	return
+}
+
+// A bucket laid out by docType, submissionDate and appName, with two files in
+// each partition.
+func newFakeTree() *fakeBucket {
+	b := &fakeBucket{}
+	for _, docType := range []string{"crash", "main", "saved_session"} {
+		for day := 1; day <= 5; day++ {
+			for _, app := range []string{"Fennec", "Firefox", "Thunderbird", "B2G"} {
+				for _, f := range []string{"a", "b"} {
+					b.keys = append(b.keys, fmt.Sprintf("data/%s/2015100%d/%s/%s", docType, day, app, f))
+				}
+			}
+		}
+	}
+	return b
+}
+
+// Collect the keys sent by a listing, sorted.
+func collectKeys(kc chan S3ListResult) (keys []string) {
+	for r := range kc {
+		if r.Err == nil {
+			keys = append(keys, r.Key.Key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
 func S3SplitFileSpec(c gs.Context) {
 	c.Specify("Sanitize dimensions", func() {
 		c.Expect("hello_there", gs.Equals, SanitizeDimension("hello!there"))
@@ -106,4 +217,1286 @@ func S3SplitFileSpec(c gs.Context) {
 		pack.Message.DeleteField(f)
 
 	})
+
+	c.Specify("Header dimensions", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_headers.json"))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(schema.Fields), gs.Equals, 6)
+		c.Expect(len(schema.HeaderIndices), gs.Equals, 5)
+		c.Expect(len(schema.FieldIndices), gs.Equals, 1)
+
+		pack := NewPipelinePack(nil)
+
+		// No headers or fields set
+		dims := schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "UNKNOWN")
+		c.Expect(dims[1], gs.Equals, "UNKNOWN")
+		c.Expect(dims[2], gs.Equals, "OTHER")
+		c.Expect(dims[3], gs.Equals, "UNKNOWN")
+
+		pack.Message.SetType("telemetry")
+		pack.Message.SetTimestamp(1420243200000000000) // 2015-01-03T00:00:00Z
+		pack.Message.SetHostname("ip-10-0-0-1")
+		pack.Message.SetEnvVersion("1")
+		pack.Message.SetLogger("telemetry")
+		f, _ := message.NewField("docType", "main", "")
+		pack.Message.AddField(f)
+
+		dims = schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "telemetry")
+		c.Expect(dims[1], gs.Equals, "main")
+		c.Expect(dims[2], gs.Equals, "20150103")
+		c.Expect(dims[3], gs.Equals, "ip-10-0-0-1")
+		c.Expect(dims[4], gs.Equals, "1")
+		c.Expect(dims[5], gs.Equals, "telemetry")
+
+		pack.Message.SetType("other")
+		pack.Message.SetTimestamp(1400000000000000000) // 2014-05-13
+		dims = schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "OTHER")
+		c.Expect(dims[2], gs.Equals, "OTHER")
+	})
+
+	c.Specify("Invalid header dimension", func() {
+		_, err := LoadSchema(filepath.Join(".", "testsupport", "schema_bad_header.json"))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Pattern dimensions", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_pattern.json"))
+		c.Expect(err, gs.IsNil)
+
+		testFieldVal(c, schema, "docType", "crash", "crash")
+		testFieldVal(c, schema, "docType", "crashSummary", "crashSummary")
+		testFieldVal(c, schema, "docType", "main", "OTHER")
+		testFieldVal(c, schema, "docType", "notacrash", "OTHER")
+
+		testFieldVal(c, schema, "appVersion", "40.0", "40.0")
+		testFieldVal(c, schema, "appVersion", "45.0a1", "45.0a1")
+		testFieldVal(c, schema, "appVersion", "4.0", "OTHER")
+		testFieldVal(c, schema, "appVersion", "50.0", "OTHER")
+		testFieldVal(c, schema, "appVersion", "4500", "OTHER")
+
+		testFieldVal(c, schema, "anywhere", "xfoox", "xfoox")
+		testFieldVal(c, schema, "anywhere", "bar", "bar")
+		testFieldVal(c, schema, "anywhere", "baz", "OTHER")
+
+		// Anchored patterns can narrow S3 listings.
+		c.Expect(schema.Dims["docType"].(PrefixDimensionChecker).ListPrefix(), gs.Equals, "crash")
+		c.Expect(schema.Dims["appVersion"].(PrefixDimensionChecker).ListPrefix(), gs.Equals, "4")
+		c.Expect(schema.Dims["anywhere"].(PrefixDimensionChecker).ListPrefix(), gs.Equals, "")
+
+		_, err = LoadSchema(filepath.Join(".", "testsupport", "schema_bad_pattern.json"))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Typed ranges", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_typed_range.json"))
+		c.Expect(err, gs.IsNil)
+
+		testFieldVal(c, schema, "numeric", "9", "9")
+		testFieldVal(c, schema, "numeric", "10", "10")
+		testFieldVal(c, schema, "numeric", "45.5", "45.5")
+		testFieldVal(c, schema, "numeric", "100", "OTHER")
+		testFieldVal(c, schema, "numeric", "8.99", "OTHER")
+		testFieldVal(c, schema, "numeric", "ten", "OTHER")
+
+		testFieldVal(c, schema, "date", "20150101", "20150101")
+		testFieldVal(c, schema, "date", "2015-01-15", "2015-01-15")
+		testFieldVal(c, schema, "date", "20150131", "20150131")
+		testFieldVal(c, schema, "date", "20150201", "OTHER")
+		testFieldVal(c, schema, "date", "20141231", "OTHER")
+		testFieldVal(c, schema, "date", "OTHER", "OTHER")
+
+		testFieldVal(c, schema, "version", "9.0", "9.0")
+		testFieldVal(c, schema, "version", "10.0", "10.0")
+		testFieldVal(c, schema, "version", "38.0.5", "38.0.5")
+		testFieldVal(c, schema, "version", "45.0a1", "45.0a1")
+		testFieldVal(c, schema, "version", "45", "45")
+		testFieldVal(c, schema, "version", "45.0.1", "OTHER")
+		testFieldVal(c, schema, "version", "100.0", "OTHER")
+		testFieldVal(c, schema, "version", "8.0", "OTHER")
+		testFieldVal(c, schema, "version", "UNKNOWN", "OTHER")
+
+		// Plain string comparison is still available (and still compares
+		// byte by byte).
+		testFieldVal(c, schema, "string", "9.5", "OTHER")
+		testFieldVal(c, schema, "string", "100", "100")
+
+		_, err = LoadSchema(filepath.Join(".", "testsupport", "schema_bad_range.json"))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Version comparisons", func() {
+		ordered := []string{"9.0", "45.0a1", "45.0a2", "45.0b1", "45.0b10", "45.0", "45.0.1", "100"}
+		for i := 1; i < len(ordered); i++ {
+			cmp, err := CompareVersions(ordered[i-1], ordered[i])
+			c.Expect(err, gs.IsNil)
+			c.Expect(cmp, gs.Equals, -1)
+			cmp, err = CompareVersions(ordered[i], ordered[i-1])
+			c.Expect(err, gs.IsNil)
+			c.Expect(cmp, gs.Equals, 1)
+		}
+		cmp, err := CompareVersions("45", "45.0.0")
+		c.Expect(err, gs.IsNil)
+		c.Expect(cmp, gs.Equals, 0)
+	})
+
+	c.Specify("Relative dates", func() {
+		now := time.Date(2015, 3, 2, 23, 59, 0, 0, time.UTC)
+		c.Expect(ResolveRelativeDate("today", now), gs.Equals, "20150302")
+		c.Expect(ResolveRelativeDate("today-7d", now), gs.Equals, "20150223")
+		c.Expect(ResolveRelativeDate("today+1d", now), gs.Equals, "20150303")
+		c.Expect(ResolveRelativeDate("today-2w", now), gs.Equals, "20150216")
+		c.Expect(ResolveRelativeDate("20150101", now), gs.Equals, "20150101")
+		c.Expect(ResolveRelativeDate("today-7", now), gs.Equals, "today-7")
+
+		// Relative dates are always evaluated in UTC.
+		pst := time.FixedZone("PST", -8*60*60)
+		c.Expect(ResolveRelativeDate("today", now.In(pst)), gs.Equals, "20150302")
+
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_relative.json"))
+		c.Expect(err, gs.IsNil)
+
+		schema.Refresh(now)
+		testFieldVal(c, schema, "submissionDate", "20150223", "20150223")
+		testFieldVal(c, schema, "submissionDate", "20150302", "20150302")
+		testFieldVal(c, schema, "submissionDate", "20150222", "OTHER")
+		testFieldVal(c, schema, "submissionDate", "20150303", "OTHER")
+		testFieldVal(c, schema, "buildDate", "2015-02-16", "2015-02-16")
+		testFieldVal(c, schema, "buildDate", "2015-02-15", "OTHER")
+
+		// Moving the clock forward moves the window.
+		schema.Refresh(now.AddDate(0, 0, 1))
+		testFieldVal(c, schema, "submissionDate", "20150223", "OTHER")
+		testFieldVal(c, schema, "submissionDate", "20150303", "20150303")
+	})
+
+	c.Specify("Dimension transforms", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_v2.json"))
+		c.Expect(err, gs.IsNil)
+
+		getDims := func(appName, clientId, channel string) []string {
+			pack := NewPipelinePack(nil)
+			for _, kv := range [][]string{{"appName", appName}, {"clientId", clientId}, {"channel", channel}} {
+				if kv[1] != "" {
+					f, _ := message.NewField(kv[0], kv[1], "")
+					pack.Message.AddField(f)
+				}
+			}
+			return schema.GetDimensions(pack)
+		}
+
+		dims := getDims("Firefox", "abcdefgh", "beta")
+		c.Expect(dims[0], gs.Equals, "firefox")
+		c.Expect(dims[1], gs.Equals, "abcd")
+		c.Expect(dims[2], gs.Equals, "beta")
+		c.Expect(dims[3], gs.Equals, "UNKNOWN")
+
+		// Case variants and aliases collapse into one partition.
+		c.Expect(getDims("FIREFOX", "", "")[0], gs.Equals, "firefox")
+		c.Expect(getDims("Fx", "", "")[0], gs.Equals, "firefox")
+		c.Expect(getDims("Android", "", "")[0], gs.Equals, "fennec")
+		c.Expect(getDims("Thunderbird", "", "")[0], gs.Equals, "OTHER")
+
+		// Short values are left alone.
+		c.Expect(getDims("", "abc", "")[1], gs.Equals, "abc")
+
+		// Missing values use the default, which is still checked.
+		dims = getDims("", "", "")
+		c.Expect(dims[0], gs.Equals, "UNKNOWN")
+		c.Expect(dims[1], gs.Equals, "UNKNOWN")
+		c.Expect(dims[2], gs.Equals, "release")
+		c.Expect(getDims("", "", "nightly")[2], gs.Equals, "OTHER")
+
+		// Transforms require a version 2 schema.
+		_, err = LoadSchema(filepath.Join(".", "testsupport", "schema_v1_transform.json"))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Fallback values", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_fallback.json"))
+		c.Expect(err, gs.IsNil)
+		c.Expect(schema.QuarantinePrefix, gs.Equals, "bad")
+
+		testFieldVal(c, schema, "docType", "main", "main")
+		testFieldVal(c, schema, "docType", "OTHER", "__rejected__")
+		testFieldVal(c, schema, "channel", "nightly", "OTHER")
+
+		check := func(docType, channel, clientId string) DimensionResult {
+			pack := NewPipelinePack(nil)
+			for _, kv := range [][]string{{"docType", docType}, {"channel", channel}, {"clientId", clientId}} {
+				if kv[1] != "" {
+					f, _ := message.NewField(kv[0], kv[1], "")
+					pack.Message.AddField(f)
+				}
+			}
+			return schema.CheckDimensions(pack)
+		}
+
+		r := check("main", "release", "abc")
+		c.Expect(r.Dims[0], gs.Equals, "main")
+		c.Expect(r.Other, gs.IsFalse)
+		c.Expect(r.Missing, gs.IsFalse)
+		c.Expect(r.Drop, gs.IsFalse)
+		c.Expect(r.Quarantine, gs.IsFalse)
+
+		r = check("", "release", "abc")
+		c.Expect(r.Dims[0], gs.Equals, "__missing__")
+		c.Expect(r.Missing, gs.IsTrue)
+		c.Expect(r.Drop, gs.IsFalse)
+		c.Expect(r.Quarantine, gs.IsFalse)
+
+		r = check("foo", "nightly", "abc")
+		c.Expect(r.Dims[0], gs.Equals, "__rejected__")
+		c.Expect(r.Dims[1], gs.Equals, "OTHER")
+		c.Expect(r.Other, gs.IsTrue)
+		c.Expect(r.Quarantine, gs.IsTrue)
+		c.Expect(r.Drop, gs.IsFalse)
+
+		r = check("main", "release", "")
+		c.Expect(r.Dims[2], gs.Equals, "UNKNOWN")
+		c.Expect(r.Missing, gs.IsTrue)
+		c.Expect(r.Drop, gs.IsTrue)
+
+		_, err = LoadSchema(filepath.Join(".", "testsupport", "schema_bad_fallback.json"))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Strict schema validation", func() {
+		expectError := func(doc string, line int, column int) {
+			_, err := ParseSchema("test.json", []byte(doc))
+			c.Expect(err, gs.Not(gs.IsNil))
+			if se, ok := err.(*SchemaError); ok {
+				c.Expect(se.Line, gs.Equals, line)
+				c.Expect(se.Column, gs.Equals, column)
+			} else {
+				c.Expect(ok, gs.IsTrue)
+			}
+		}
+
+		valid := `{"version": 1, "dimensions": [{"field_name": "a", "allowed_values": "*"}]}`
+		_, err := ParseSchema("test.json", []byte(valid))
+		c.Expect(err, gs.IsNil)
+
+		// Unsupported types for allowed_values.
+		expectError("{\"version\": 1,\n \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": 5}]}", 3, 3)
+		expectError("{\"version\": 1,\n \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": null}]}", 3, 3)
+		expectError("{\"version\": 1,\n \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": [[\"x\"]]}]}", 3, 3)
+		expectError("{\"version\": 1,\n \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": []}]}", 3, 3)
+		expectError("{\"version\": 1,\n \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": {\"min\": \"b\", \"max\": \"a\"}}]}", 3, 3)
+
+		// Missing or unsupported version.
+		expectError(`{"dimensions": []}`, 1, 1)
+		expectError("{\n  \"version\": 3, \"dimensions\": []}", 2, 3)
+
+		// Duplicate and missing field names.
+		expectError("{\"version\": 1, \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": \"*\"},\n  {\"field_name\": \"a\", \"allowed_values\": \"*\"}]}", 3, 3)
+		expectError("{\"version\": 1, \"dimensions\": [\n  {\"allowed_values\": \"*\"}]}", 2, 3)
+
+		// Misspelled keys.
+		expectError("{\"version\": 1, \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_value\": \"*\"}]}", 2, 3)
+		expectError("{\"version\": 1,\n\"dimension\": []}", 2, 1)
+
+		// Syntax errors.
+		expectError("{\"version\": 1,\n \"dimensions\": [}", 2, 17)
+
+		// Values of the wrong type.
+		expectError("{\"dimensions\": [],\n  \"version\": \"1\"}", 2, 3)
+		expectError("{\"version\": 1, \"dimensions\": [\n  {\"field_name\": \"a\", \"allowed_values\": \"*\"},\n  {\"field_name\": 5}]}", 3, 3)
+		expectError("{\"version\": 1, \"dimensions\": {}}", 1, 16)
+	})
+
+	c.Specify("Exclusions", func() {
+		schema, err := ParseSchema("test.json", []byte(`{
+			"version": 1,
+			"dimensions": [
+				{"field_name": "channel", "allowed_values": {"not": ["default", "esr"]}},
+				{"field_name": "docType", "allowed_values": {"not": {"pattern": "^crash"}}},
+				{"field_name": "single",  "allowed_values": {"not": "foo"}},
+				{"field_name": "date",    "allowed_values": {"not": {"min": "today-7d"}}}
+			]
+		}`))
+		c.Expect(err, gs.IsNil)
+
+		testFieldVal(c, schema, "channel", "release", "release")
+		testFieldVal(c, schema, "channel", "nightly", "nightly")
+		testFieldVal(c, schema, "channel", "default", "OTHER")
+		testFieldVal(c, schema, "channel", "esr", "OTHER")
+
+		testFieldVal(c, schema, "docType", "main", "main")
+		testFieldVal(c, schema, "docType", "crash", "OTHER")
+		testFieldVal(c, schema, "docType", "crashSummary", "OTHER")
+
+		testFieldVal(c, schema, "single", "bar", "bar")
+		testFieldVal(c, schema, "single", "foo", "OTHER")
+
+		// Excluded dimensions can't be listed value by value.
+		_, ok := schema.Dims["channel"].ListValues()
+		c.Expect(ok, gs.IsFalse)
+
+		// Relative dates inside an exclusion are refreshed too.
+		schema.Refresh(time.Date(2015, 3, 2, 0, 0, 0, 0, time.UTC))
+		testFieldVal(c, schema, "date", "20150222", "20150222")
+		testFieldVal(c, schema, "date", "20150223", "OTHER")
+
+		_, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "a", "allowed_values": {"not": "*"}}]}`))
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "a", "allowed_values": {"not": ["a"], "min": "b"}}]}`))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Hashed dimensions", func() {
+		schema, err := ParseSchema("test.json", []byte(`{
+			"version": 1,
+			"dimensions": [
+				{"field_name": "sampleId", "hash_of": "clientId", "buckets": 100},
+				{"field_name": "docType",  "allowed_values": "*"},
+				{"field_name": "hostId",   "hash_of": "Hostname", "buckets": 10, "allowed_values": ["1", "2"]}
+			]
+		}`))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(schema.FieldIndices), gs.Equals, 1)
+		c.Expect(len(schema.ComputedIndices), gs.Equals, 2)
+
+		c.Expect(HashBucket("abc", 100), gs.Equals, "78")
+		c.Expect(HashBucket("abc", 1), gs.Equals, "0")
+
+		pack := NewPipelinePack(nil)
+		dims := schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "UNKNOWN")
+		c.Expect(dims[2], gs.Equals, "UNKNOWN")
+
+		f, _ := message.NewField("clientId", "abc", "")
+		pack.Message.AddField(f)
+		f, _ = message.NewField("docType", "main", "")
+		pack.Message.AddField(f)
+		pack.Message.SetHostname("abc")
+		dims = schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "78")
+		c.Expect(dims[1], gs.Equals, "main")
+		c.Expect(dims[2], gs.Equals, "OTHER")
+
+		// The computed value replaces any field of the same name.
+		f, _ = message.NewField("sampleId", "5", "")
+		pack.Message.AddField(f)
+		c.Expect(schema.GetDimensions(pack)[0], gs.Equals, "78")
+
+		for _, bad := range []string{
+			`{"field_name": "a", "hash_of": "b"}`,
+			`{"field_name": "a", "hash_of": "b", "buckets": -1}`,
+			`{"field_name": "a", "allowed_values": "*", "buckets": 10}`,
+			`{"header_name": "Type", "hash_of": "b", "buckets": 10}`,
+		} {
+			_, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [`+bad+`]}`))
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+	})
+
+	c.Specify("Time bucket dimensions", func() {
+		schema, err := ParseSchema("test.json", []byte(`{
+			"version": 1,
+			"dimensions": [
+				{"derived": "Timestamp"},
+				{"field_name": "hour", "derived": "Timestamp", "format": "2006010215", "granularity": "1h"},
+				{"field_name": "created", "derived": "creationDate", "format": "2006-01-02T15:04", "granularity": "15m"},
+				{"field_name": "recent", "derived": "Timestamp", "format": "2006010215", "allowed_values": {"min": "2015010312", "type": "date"}}
+			]
+		}`))
+		c.Expect(err, gs.IsNil)
+		c.Expect(schema.Fields[0], gs.Equals, "Timestamp")
+		c.Expect(len(schema.ComputedIndices), gs.Equals, 4)
+
+		pack := NewPipelinePack(nil)
+		pack.Message.SetTimestamp(1420253999000000000) // 2015-01-03T02:59:59Z
+		dims := schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "20150103")
+		c.Expect(dims[1], gs.Equals, "2015010302")
+		c.Expect(dims[2], gs.Equals, "UNKNOWN")
+		c.Expect(dims[3], gs.Equals, "OTHER")
+
+		f, _ := message.NewField("creationDate", "2015-01-03T02:59:59Z", "")
+		pack.Message.AddField(f)
+		c.Expect(schema.GetDimensions(pack)[2], gs.Equals, "2015-01-03T02:45")
+
+		pack = NewPipelinePack(nil)
+		pack.Message.SetTimestamp(1420290000000000000) // 2015-01-03T13:00:00Z
+		f, _ = message.NewField("creationDate", int64(1420290000000000000), "")
+		pack.Message.AddField(f)
+		dims = schema.GetDimensions(pack)
+		c.Expect(dims[1], gs.Equals, "2015010313")
+		c.Expect(dims[2], gs.Equals, "2015-01-03T13:00")
+		c.Expect(dims[3], gs.Equals, "2015010313")
+
+		pack = NewPipelinePack(nil)
+		f, _ = message.NewField("creationDate", "yesterday", "")
+		pack.Message.AddField(f)
+		c.Expect(schema.GetDimensions(pack)[2], gs.Equals, "UNKNOWN")
+
+		for _, bad := range []string{
+			`{"derived": "Timestamp", "granularity": "soon"}`,
+			`{"derived": "Timestamp", "granularity": "-1h"}`,
+			`{"derived": "Type"}`,
+			`{"field_name": "a", "derived": "b", "hash_of": "c", "buckets": 2}`,
+			`{"field_name": "a", "allowed_values": "*", "format": "2006"}`,
+		} {
+			_, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [`+bad+`]}`))
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+	})
+
+	c.Specify("Matcher generation", func() {
+		toMatcher := func(dims string) (string, error) {
+			schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [`+dims+`]}`))
+			c.Expect(err, gs.IsNil)
+			return schema.ToMatcher()
+		}
+		expectMatcher := func(dims string, expected string) {
+			m, err := toMatcher(dims)
+			c.Expect(err, gs.IsNil)
+			c.Expect(m, gs.Equals, expected)
+		}
+
+		expectMatcher(`{"field_name": "a", "allowed_values": "*"}`, "TRUE")
+		expectMatcher(`{"field_name": "a", "allowed_values": "*"},
+			{"header_name": "Type", "allowed_values": "telemetry"},
+			{"field_name": "reason", "allowed_values": ["saved-session", "idle-daily"]}`,
+			"Type == 'telemetry' && (Fields[reason] =~ /^idle[^a-zA-Z0-9\\/.]daily$/ || Fields[reason] =~ /^saved[^a-zA-Z0-9\\/.]session$/)")
+		// The pattern accepts the same raw values as the schema.
+		schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [{"field_name": "reason", "allowed_values": ["saved-session"]}]}`))
+		c.Expect(err, gs.IsNil)
+		m, err := schema.ToMatcher()
+		c.Expect(err, gs.IsNil)
+		pattern := regexp.MustCompile(strings.Replace(m[strings.Index(m, "/")+1:len(m)-1], `\/`, "/", -1))
+		for _, v := range []string{"saved-session", "saved_session", "saved session", "savedXsession", "saved/session", "saved-session2"} {
+			c.Expect(pattern.MatchString(v), gs.Equals, schema.Dims["reason"].IsAllowed(v))
+		}
+		expectMatcher(`{"field_name": "reason", "allowed_values": {"not": ["a.b_c"]}}`,
+			`Fields[reason] !~ /^a\.b[^a-zA-Z0-9\/.]c$/`)
+		expectMatcher(`{"field_name": "d", "allowed_values": {"min": "20150101", "max": "20150131"}}`,
+			"(Fields[d] >= '20150101' && Fields[d] <= '20150131')")
+		expectMatcher(`{"header_name": "Severity", "allowed_values": {"min": "3", "type": "numeric"}}`,
+			"Severity >= 3")
+		expectMatcher(`{"header_name": "Pid", "allowed_values": {"not": {"min": "10", "max": "20", "type": "numeric"}}}`,
+			"(Pid < 10 || Pid > 20)")
+		expectMatcher(`{"header_name": "Severity", "allowed_values": {"not": ["7", "6"]}}`,
+			"(Severity != 6 && Severity != 7)")
+		expectMatcher(`{"field_name": "v", "allowed_values": {"pattern": "^4[0-9]/x"}}`,
+			`Fields[v] =~ /^4[0-9]\/x/`)
+		expectMatcher(`{"field_name": "v", "allowed_values": {"not": {"pattern": "^crash"}}}`,
+			"Fields[v] !~ /^crash/")
+		expectMatcher(`{"header_name": "Timestamp", "allowed_values": "20150103"}`,
+			"(Timestamp >= 1420243200000000000 && Timestamp < 1420329600000000000)")
+		expectMatcher(`{"header_name": "Timestamp", "allowed_values": {"min": "20150103", "max": "20150103"}}`,
+			"(Timestamp >= 1420243200000000000 && Timestamp < 1420329600000000000)")
+		expectMatcher(`{"header_name": "Timestamp", "allowed_values": {"not": {"min": "20150103"}}}`,
+			"Timestamp < 1420243200000000000")
+
+		for _, bad := range []string{
+			`{"field_name": "v", "allowed_values": {"min": "45.0", "type": "version"}}`,
+			`{"field_name": "n", "allowed_values": {"min": "10", "type": "numeric"}}`,
+			`{"field_name": "d", "allowed_values": {"min": "20150101", "type": "date"}}`,
+			`{"header_name": "Severity", "allowed_values": {"min": "3"}}`,
+			`{"header_name": "Pid", "allowed_values": "abc"}`,
+			`{"header_name": "Timestamp", "allowed_values": {"pattern": "^2015"}}`,
+			`{"field_name": "s", "hash_of": "clientId", "buckets": 10, "allowed_values": "1"}`,
+		} {
+			_, err := toMatcher(bad)
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+	})
+
+	c.Specify("Dimension encodings", func() {
+		for _, v := range []string{"en-US", "en_US", "a/b", "100%", "Ünïcødé", "", "OTHER"} {
+			for _, encoding := range []string{EncodingPercent, EncodingBase32} {
+				encoded := EncodeDimension(encoding, v)
+				c.Expect(strings.Contains(encoded, "/"), gs.IsFalse)
+				decoded, err := DecodeDimension(encoding, encoded)
+				c.Expect(err, gs.IsNil)
+				c.Expect(decoded, gs.Equals, v)
+			}
+		}
+		c.Expect(EncodeDimension(EncodingPercent, "en-US a/b%"), gs.Equals, "en-US%20a%2Fb%25")
+		c.Expect(EncodeDimension(EncodingBase32, "en-US"), gs.Equals, "MVXC2VKT")
+		c.Expect(EncodeDimension(EncodingSanitize, "en-US"), gs.Equals, "en_US")
+
+		_, err := PercentDecodeDimension("abc%2")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = PercentDecodeDimension("abc%zz")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = Base32DecodeDimension("not base32!")
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		schema, err := ParseSchema("test.json", []byte(`{
+			"version": 1,
+			"encoding": "percent",
+			"dimensions": [
+				{"field_name": "locale", "allowed_values": ["en-US", "de"]},
+				{"field_name": "os",     "allowed_values": "*"}
+			]
+		}`))
+		c.Expect(err, gs.IsNil)
+		c.Expect(schema.Encoding, gs.Equals, EncodingPercent)
+		testFieldVal(c, schema, "locale", "en-US", "en-US")
+		testFieldVal(c, schema, "locale", "en_US", "OTHER")
+		values, _ := schema.Dims["locale"].ListValues()
+		c.Expect(values[1], gs.Equals, "en-US")
+
+		dims, err := schema.DecodeDimensionPath("en-US/Windows%20NT/20150103_host")
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(dims), gs.Equals, 2)
+		c.Expect(dims[0], gs.Equals, "en-US")
+		c.Expect(dims[1], gs.Equals, "Windows NT")
+
+		c.Expect(schema.encodeListPrefix("en-"), gs.Equals, "en-")
+		schema.Encoding = EncodingSanitize
+		c.Expect(schema.encodeListPrefix("en-"), gs.Equals, "")
+		c.Expect(schema.encodeListPrefix("en_"), gs.Equals, "en_")
+
+		_, err = ParseSchema("test.json", []byte(`{"version": 1, "encoding": "rot13", "dimensions": []}`))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Cardinality limits", func() {
+		schema, err := ParseSchema("test.json", []byte(`{
+			"version": 1,
+			"dimensions": [
+				{"field_name": "docType",    "allowed_values": "*"},
+				{"field_name": "appVersion", "allowed_values": "*", "max_distinct_values": 2},
+				{"field_name": "channel",    "allowed_values": "*", "max_distinct_values": 1,
+				 "other_value": "OTHER_CHANNEL"},
+				{"field_name": "os",         "allowed_values": "*", "max_distinct_values": 1,
+				 "overflow_value": "TOO_MANY"}
+			]
+		}`))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(schema.Limits), gs.Equals, 3)
+
+		start := time.Date(2015, 1, 3, 0, 0, 0, 0, time.UTC)
+		guard := NewCardinalityGuard(schema, time.Hour)
+		check := func(dims []string, now time.Time, expectOverflow bool) {
+			c.Expect(guard.Check(dims, now), gs.Equals, expectOverflow)
+		}
+
+		dims := []string{"main", "40.0", "release", "Linux"}
+		check(dims, start, false)
+		dims = []string{"crash", "41.0", "release", "Linux"}
+		check(dims, start, false)
+		dims = []string{"other", "42.0", "beta", "Darwin"}
+		check(dims, start, true)
+		c.Expect(dims[0], gs.Equals, "other")
+		c.Expect(dims[1], gs.Equals, "OTHER")
+		c.Expect(dims[2], gs.Equals, "OTHER_CHANNEL")
+		c.Expect(dims[3], gs.Equals, "TOO_MANY")
+
+		// Values already seen are still allowed.
+		dims = []string{"main", "40.0", "release", "Linux"}
+		check(dims, start.Add(time.Minute), false)
+
+		// Fallback values don't count towards the limit.
+		dims = []string{"main", "UNKNOWN", "OTHER_CHANNEL", "Linux"}
+		check(dims, start.Add(time.Minute), false)
+		c.Expect(dims[1], gs.Equals, "UNKNOWN")
+		c.Expect(dims[2], gs.Equals, "OTHER_CHANNEL")
+
+		counts := guard.Counts()
+		c.Expect(len(counts), gs.Equals, 3)
+		c.Expect(counts[0].Field, gs.Equals, "appVersion")
+		c.Expect(counts[0].DistinctValues, gs.Equals, int64(2))
+		c.Expect(counts[0].OverflowCount, gs.Equals, int64(1))
+		c.Expect(counts[2].Field, gs.Equals, "os")
+
+		// A new window starts over.
+		dims = []string{"other", "42.0", "beta", "Darwin"}
+		check(dims, start.Add(time.Hour), false)
+		c.Expect(dims[1], gs.Equals, "42.0")
+		counts = guard.Counts()
+		c.Expect(counts[0].DistinctValues, gs.Equals, int64(1))
+		c.Expect(counts[0].OverflowCount, gs.Equals, int64(1))
+
+		// A value shared by the combinations a message fans out to is
+		// counted once.
+		later := start.Add(time.Hour + time.Minute)
+		c.Expect(guard.CheckAll([][]string{{"x", "43.0", "beta", "Darwin"}, {"y", "43.0", "beta", "Darwin"}}, later), gs.IsFalse)
+		combinations := [][]string{{"x", "44.0", "beta", "Darwin"}, {"y", "44.0", "beta", "Darwin"}}
+		c.Expect(guard.CheckAll(combinations, later), gs.IsTrue)
+		c.Expect(combinations[1][1], gs.Equals, "OTHER")
+		counts = guard.Counts()
+		c.Expect(counts[0].DistinctValues, gs.Equals, int64(2))
+		c.Expect(counts[0].OverflowCount, gs.Equals, int64(2))
+
+		// A schema without limits doesn't need a guard.
+		schema, _ = LoadSchema(filepath.Join(".", "testsupport", "schema.json"))
+		guard = NewCardinalityGuard(schema, time.Hour)
+		c.Expect(guard == nil, gs.IsTrue)
+		c.Expect(guard.Check([]string{"a"}, start), gs.IsFalse)
+
+		for _, bad := range []string{
+			`{"field_name": "a", "allowed_values": "*", "max_distinct_values": -1}`,
+			`{"field_name": "a", "allowed_values": "*", "overflow_value": "X"}`,
+			`{"field_name": "a", "allowed_values": "*", "max_distinct_values": 1, "overflow_value": ""}`,
+		} {
+			_, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [`+bad+`]}`))
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+	})
+
+	c.Specify("Field addresses and multiple values", func() {
+		schema, err := ParseSchema("test.json", []byte(`{
+			"version": 1,
+			"dimensions": [
+				{"field_name": "Fields[branch][1][0]", "allowed_values": "*"},
+				{"field_name": "Fields[tags][0]", "allowed_values": "*", "multi_value": "last"},
+				{"field_name": "tags", "allowed_values": "*", "multi_value": "joined", "separator": "+"},
+				{"field_name": "experiments", "allowed_values": ["a", "b", "c"], "multi_value": "fan_out"},
+				{"field_name": "plain", "allowed_values": "*"}
+			]
+		}`))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(schema.ComputedIndices), gs.Equals, 4)
+		c.Expect(len(schema.FieldIndices), gs.Equals, 1)
+
+		pack := NewPipelinePack(nil)
+		f, _ := message.NewField("branch", "control", "")
+		pack.Message.AddField(f)
+		f, _ = message.NewField("branch", "treatment", "")
+		f.AddValue("other")
+		pack.Message.AddField(f)
+		f, _ = message.NewField("tags", "x", "")
+		f.AddValue("y")
+		f.AddValue("z")
+		pack.Message.AddField(f)
+		f, _ = message.NewField("experiments", "a", "")
+		f.AddValue("b")
+		f.AddValue("a")
+		f.AddValue("d")
+		pack.Message.AddField(f)
+
+		dims := schema.GetDimensions(pack)
+		c.Expect(dims[0], gs.Equals, "treatment")
+		c.Expect(dims[1], gs.Equals, "z")
+		c.Expect(dims[2], gs.Equals, "x+y+z")
+		c.Expect(dims[3], gs.Equals, "a")
+		c.Expect(dims[4], gs.Equals, "UNKNOWN")
+
+		results := schema.CheckAllDimensions(pack)
+		c.Expect(len(results), gs.Equals, 3)
+		c.Expect(results[0].Dims[3], gs.Equals, "a")
+		c.Expect(results[1].Dims[3], gs.Equals, "b")
+		c.Expect(results[2].Dims[3], gs.Equals, "OTHER")
+		c.Expect(results[2].Dims[2], gs.Equals, "x+y+z")
+
+		// Out of range indexes are missing.
+		fs, err := ParseFieldSelector("Fields[branch][1][5]")
+		c.Expect(err, gs.IsNil)
+		c.Expect(fs.Compute(pack.Message), gs.Equals, "")
+		fs, _ = ParseFieldSelector("Fields[branch][2]")
+		c.Expect(fs.Compute(pack.Message), gs.Equals, "")
+
+		// The output counts each message once, not once per partition.
+		o := &S3SplitFileOutput{schema: schema}
+		dimPaths := o.getDimPaths(pack)
+		c.Expect(len(dimPaths), gs.Equals, 3)
+		c.Expect(o.fallbackMissingCount, gs.Equals, int64(1))
+		c.Expect(o.fallbackOtherCount, gs.Equals, int64(1))
+
+		// Messages without fan-out values have a single result.
+		pack = NewPipelinePack(nil)
+		results = schema.CheckAllDimensions(pack)
+		c.Expect(len(results), gs.Equals, 1)
+		c.Expect(results[0].Dims[3], gs.Equals, "UNKNOWN")
+
+		schema, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "Fields[branch][1]", "allowed_values": "control"}]}`))
+		c.Expect(err, gs.IsNil)
+		m, err := schema.ToMatcher()
+		c.Expect(err, gs.IsNil)
+		c.Expect(m, gs.Equals, "Fields[branch][1][0] == 'control'")
+
+		for _, bad := range []string{
+			`{"field_name": "Fields[branch", "allowed_values": "*"}`,
+			`{"field_name": "Fields[branch][x]", "allowed_values": "*"}`,
+			`{"field_name": "Fields[a][0][0]", "allowed_values": "*", "multi_value": "last"}`,
+			`{"field_name": "a", "allowed_values": "*", "multi_value": "all"}`,
+			`{"field_name": "a", "allowed_values": "*", "separator": "-"}`,
+			`{"header_name": "Type", "allowed_values": "*", "multi_value": "last"}`,
+		} {
+			_, err = ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [`+bad+`]}`))
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+	})
+
+	c.Specify("List retries", func() {
+		for attempt := 1; attempt <= 10; attempt++ {
+			delay := listRetryDelay << uint(attempt-1)
+			if delay > listRetryMaxDelay {
+				delay = listRetryMaxDelay
+			}
+			backoff := listBackoff(attempt)
+			c.Expect(backoff >= delay/2, gs.IsTrue)
+			c.Expect(backoff <= delay, gs.IsTrue)
+		}
+
+		c.Expect(isRetryableListError(errors.New("connection reset")), gs.IsTrue)
+		c.Expect(isRetryableListError(&s3.Error{StatusCode: 503, Code: "SlowDown"}), gs.IsTrue)
+		c.Expect(isRetryableListError(&s3.Error{StatusCode: 500, Code: "InternalError"}), gs.IsTrue)
+		c.Expect(isRetryableListError(&s3.Error{StatusCode: 403, Code: "AccessDenied"}), gs.IsFalse)
+		c.Expect(isRetryableListError(&s3.Error{StatusCode: 404, Code: "NoSuchBucket"}), gs.IsFalse)
+	})
+
+	c.Specify("Listing cache", func() {
+		dir, err := ioutil.TempDir("", "listing-cache")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+
+		schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "docType", "allowed_values": "*"},
+			{"field_name": "submissionDate", "allowed_values": "*"}]}`))
+		c.Expect(err, gs.IsNil)
+
+		_, err = OpenListingCache(dir, "bucket", "data/", schema, "missing", time.Hour)
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		now := time.Date(2015, 10, 20, 12, 0, 0, 0, time.UTC)
+		cache, err := OpenListingCache(dir, "bucket", "data/", schema, "submissionDate", 48*time.Hour)
+		c.Expect(err, gs.IsNil)
+
+		// Nothing is cached yet.
+		_, ok := cache.Lookup("data/main/20151001/", now)
+		c.Expect(ok, gs.IsFalse)
+
+		cache.Store("data/main/20151001/", []s3.Key{{Key: "data/main/20151001/a", Size: 10, ETag: "e1"}})
+		cache.Store("data/main/20151019/", []s3.Key{{Key: "data/main/20151019/b", Size: 20}})
+		c.Expect(cache.Save(), gs.IsNil)
+
+		cache, err = OpenListingCache(dir, "bucket", "data/", schema, "submissionDate", 48*time.Hour)
+		c.Expect(err, gs.IsNil)
+
+		keys, ok := cache.Lookup("data/main/20151001/", now)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(len(keys), gs.Equals, 1)
+		c.Expect(keys[0].Key, gs.Equals, "data/main/20151001/a")
+		c.Expect(keys[0].Size, gs.Equals, int64(10))
+		c.Expect(keys[0].ETag, gs.Equals, "e1")
+
+		// Prefixes in the hot window, or without a date, are listed again.
+		_, ok = cache.Lookup("data/main/20151019/", now)
+		c.Expect(ok, gs.IsFalse)
+		_, ok = cache.Lookup("data/main/OTHER/", now)
+		c.Expect(ok, gs.IsFalse)
+
+		// As time passes, prefixes leave the hot window.
+		_, ok = cache.Lookup("data/main/20151019/", now.Add(48*time.Hour))
+		c.Expect(ok, gs.IsTrue)
+
+		// A different layout doesn't share the cache.
+		other, err := ParseSchema("test.json", []byte(`{"version": 1, "encoding": "percent", "dimensions": [
+			{"field_name": "docType", "allowed_values": "*"},
+			{"field_name": "submissionDate", "allowed_values": "*"}]}`))
+		c.Expect(err, gs.IsNil)
+		cache, err = OpenListingCache(dir, "bucket", "data/", other, "submissionDate", 48*time.Hour)
+		c.Expect(err, gs.IsNil)
+		_, ok = cache.Lookup("data/main/20151001/", now)
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("Parallel listing", func() {
+		schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "docType", "allowed_values": ["main", "crash"]},
+			{"field_name": "submissionDate", "allowed_values": {"min": "20151002", "max": "20151004"}},
+			{"field_name": "appName", "allowed_values": "*"}]}`))
+		c.Expect(err, gs.IsNil)
+		bucket := newFakeTree()
+		// Small pages, so that listings are continued from a marker.
+		bucket.pageSize = 3
+		l := &s3Lister{bucket: bucket, schema: schema}
+
+		// Collect the keys from a listing, which must close the channel
+		// within a few seconds. Closing it a second time would panic.
+		run := func(list func(kc chan S3ListResult)) (keys []string) {
+			kc := make(chan S3ListResult)
+			done := make(chan []string)
+			go list(kc)
+			go func() { done <- collectKeys(kc) }()
+			select {
+			case keys = <-done:
+			case <-time.After(5 * time.Second):
+				c.Expect("the listing", gs.Equals, "finished")
+			}
+			return
+		}
+
+		serial := run(func(kc chan S3ListResult) {
+			l.filter(context.Background(), "data/", 0, kc)
+		})
+		c.Expect(len(serial), gs.Equals, 2*3*4*2)
+		c.Expect(serial[0], gs.Equals, "data/crash/20151002/B2G/a")
+
+		for _, concurrency := range []int{1, 2, 4, 16} {
+			parallel := run(func(kc chan S3ListResult) {
+				l.filterParallel(context.Background(), "data/", concurrency, kc)
+			})
+			c.Expect(strings.Join(parallel, ","), gs.Equals, strings.Join(serial, ","))
+		}
+
+		// An empty tree, or one with nothing allowed, still ends the listing.
+		empty := &s3Lister{bucket: &fakeBucket{}, schema: schema}
+		keys := run(func(kc chan S3ListResult) {
+			empty.filterParallel(context.Background(), "data/", 4, kc)
+		})
+		c.Expect(len(keys), gs.Equals, 0)
+		keys = run(func(kc chan S3ListResult) {
+			l.filterParallel(context.Background(), "other/", 4, kc)
+		})
+		c.Expect(len(keys), gs.Equals, 0)
+
+		// Cancelling part way through stops the listing, even if nothing is
+		// reading the channel any more.
+		for _, concurrency := range []int{1, 4} {
+			ctx, cancel := context.WithCancel(context.Background())
+			kc := make(chan S3ListResult)
+			finished := make(chan struct{})
+			go func() {
+				l.filterParallel(ctx, "data/", concurrency, kc)
+				close(finished)
+			}()
+			r := <-kc
+			c.Expect(r.Err, gs.IsNil)
+			cancel()
+			select {
+			case <-finished:
+			case <-time.After(5 * time.Second):
+				c.Expect("the cancelled listing", gs.Equals, "finished")
+			}
+			for _ = range kc {
+				// Anything already sent before the channel was closed.
+			}
+		}
+
+		// Cancelling from within a List request stops further requests.
+		ctx, cancel := context.WithCancel(context.Background())
+		var lists int
+		bucket.onList = func(prefix string) {
+			bucket.lock.Lock()
+			lists++
+			if lists == 5 {
+				cancel()
+			}
+			bucket.lock.Unlock()
+		}
+		keys = run(func(kc chan S3ListResult) {
+			l.filterParallel(ctx, "data/", 4, kc)
+		})
+		c.Expect(len(keys) < len(serial), gs.IsTrue)
+		bucket.lock.Lock()
+		c.Expect(lists <= 5+4, gs.IsTrue)
+		bucket.lock.Unlock()
+	})
+
+	c.Specify("Cancellation", func() {
+		// Wait for something to finish, failing if it takes too long.
+		wait := func(what string, finished chan struct{}) {
+			select {
+			case <-finished:
+			case <-time.After(5 * time.Second):
+				c.Expect(what, gs.Equals, "finished")
+			}
+		}
+
+		// A List request that keeps failing is not retried once the context
+		// is cancelled, even part way through the backoff.
+		ctx, cancel := context.WithCancel(context.Background())
+		failing := &fakeBucket{err: &s3.Error{StatusCode: 503, Code: "ServiceUnavailable"}}
+		failing.onList = func(prefix string) { cancel() }
+		_, err := listWithRetry(ctx, failing, "data/", "")
+		c.Expect(err, gs.Equals, context.Canceled)
+		c.Expect(failing.listCount(""), gs.Equals, 1)
+
+		// Cancelling a serial listing stops it and closes the channel, even
+		// if nothing is reading it any more.
+		schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "docType", "allowed_values": "*"},
+			{"field_name": "submissionDate", "allowed_values": "*"},
+			{"field_name": "appName", "allowed_values": "*"}]}`))
+		c.Expect(err, gs.IsNil)
+		bucket := newFakeTree()
+		l := &s3Lister{bucket: bucket, schema: schema}
+		ctx, cancel = context.WithCancel(context.Background())
+		kc := make(chan S3ListResult)
+		finished := make(chan struct{})
+		go func() {
+			l.filter(ctx, "data/", 0, kc)
+			close(finished)
+		}()
+		r := <-kc
+		c.Expect(r.Err, gs.IsNil)
+		cancel()
+		wait("the cancelled listing", finished)
+		keys := collectKeys(kc)
+		c.Expect(len(keys) < len(bucket.keys)-1, gs.IsTrue)
+		c.Expect(bucket.listCount("data/saved_session/"), gs.Equals, 0)
+
+		// Cancelling while reading records interrupts a blocked read and
+		// closes the channel.
+		splitter, err := NewSplitter(SplitterToken, "")
+		c.Expect(err, gs.IsNil)
+		pr, pw := io.Pipe()
+		ctx, cancel = context.WithCancel(context.Background())
+		recordChan := make(chan S3Record)
+		finished = make(chan struct{})
+		go func() {
+			readRecords(ctx, pr, "key", CompressionNone, 0, splitter, recordChan)
+			close(recordChan)
+			close(finished)
+		}()
+		go pw.Write([]byte("one\ntwo\n"))
+		rec := <-recordChan
+		c.Expect(string(rec.Record), gs.Equals, "one\n")
+		rec = <-recordChan
+		c.Expect(string(rec.Record), gs.Equals, "two\n")
+		// The reader is now blocked waiting for more data.
+		cancel()
+		wait("the cancelled read", finished)
+		for _ = range recordChan {
+			c.Expect("no more records", gs.Equals, "after cancelling")
+		}
+		_, err = pw.Write([]byte("three\n"))
+		c.Expect(err, gs.Equals, io.ErrClosedPipe)
+	})
+
+	c.Specify("Listing cache skips cold dates", func() {
+		dir, err := ioutil.TempDir("", "listing-cache")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+
+		schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "docType", "allowed_values": "*"},
+			{"field_name": "submissionDate", "allowed_values": "*"},
+			{"field_name": "appName", "allowed_values": "*"}]}`))
+		c.Expect(err, gs.IsNil)
+		bucket := &fakeBucket{keys: []string{
+			"data/main/20151001/Firefox/a",
+			"data/main/20151001/Fennec/b",
+			"data/main/20151019/Firefox/c",
+			"data/crash/20151001/Firefox/d",
+		}}
+		now := time.Date(2015, 10, 20, 12, 0, 0, 0, time.UTC)
+
+		list := func() []string {
+			cache, err := OpenListingCache(dir, "bucket", "data/", schema, "submissionDate", 48*time.Hour)
+			c.Expect(err, gs.IsNil)
+			bucket.listed = nil
+			kc := make(chan S3ListResult, 10)
+			l := &s3Lister{bucket: bucket, schema: schema, cache: cache, now: now}
+			go l.filter(context.Background(), "data/", 0, kc)
+			keys := collectKeys(kc)
+			c.Expect(cache.Save(), gs.IsNil)
+			return keys
+		}
+
+		c.Expect(strings.Join(list(), ","), gs.Equals,
+			"data/crash/20151001/Firefox/d,data/main/20151001/Fennec/b,data/main/20151001/Firefox/a,data/main/20151019/Firefox/c")
+		c.Expect(bucket.listCount("data/main/20151001/"), gs.Equals, 3)
+
+		// The second time around, the cold dates aren't listed at all, while
+		// the levels above the dates and the hot date are.
+		c.Expect(len(list()), gs.Equals, 4)
+		c.Expect(bucket.listCount("data/main/20151001/"), gs.Equals, 0)
+		c.Expect(bucket.listCount("data/crash/20151001/"), gs.Equals, 0)
+		c.Expect(bucket.listCount("data/main/20151019/"), gs.Equals, 2)
+		c.Expect(bucket.listCount("data/"), gs.Equals, 5)
+	})
+
+	c.Specify("Inventory listing", func() {
+		dir, err := ioutil.TempDir("", "inventory")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+
+		manifest := `{"sourceBucket": "src", "destinationBucket": "arn:aws:s3:::dest",
+			"fileFormat": "CSV", "fileSchema": "Bucket, Key, Size, LastModifiedDate, ETag",
+			"files": [{"key": "inv/src/all/data/one.csv.gz"}, {"key": "inv/src/all/data/two.csv"}]}`
+		c.Expect(ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0644), gs.IsNil)
+
+		f, err := os.Create(filepath.Join(dir, "one.csv.gz"))
+		c.Expect(err, gs.IsNil)
+		gz := gzip.NewWriter(f)
+		gz.Write([]byte(`"src","data/main/20151001/a","10","2015-10-01T10:00:00.000Z","e1"
+"src","data/main/20150901/b","20","2015-09-01T10:00:00.000Z","e2"
+"src","data/crash/20151001/c","30","2015-10-01T10:00:00.000Z","e3"
+"src","data/main/20151001/extra/d","40","2015-10-01T10:00:00.000Z","e4"
+`))
+		gz.Close()
+		f.Close()
+		two := `"src","data/main/20151002/e%20f","50","2015-10-02T10:00:00.000Z","e5"
+"src","other/main/20151002/g","60","2015-10-02T10:00:00.000Z","e6"
+`
+		c.Expect(ioutil.WriteFile(filepath.Join(dir, "two.csv"), []byte(two), 0644), gs.IsNil)
+
+		schema, err := ParseSchema("test.json", []byte(`{"version": 1, "dimensions": [
+			{"field_name": "docType", "allowed_values": ["main"]},
+			{"field_name": "submissionDate", "allowed_values": {"min": "20151001"}}]}`))
+		c.Expect(err, gs.IsNil)
+
+		var keys []string
+		for r := range S3InventoryIterator(context.Background(), nil, filepath.Join(dir, "manifest.json"), "data/", schema) {
+			c.Expect(r.Err, gs.IsNil)
+			keys = append(keys, r.Key.Key)
+			if r.Key.Key == "data/main/20151001/a" {
+				c.Expect(r.Key.Size, gs.Equals, int64(10))
+				c.Expect(r.Key.ETag, gs.Equals, "e1")
+			}
+		}
+		c.Expect(strings.Join(keys, ","), gs.Equals, "data/main/20151001/a,data/main/20151002/e f")
+
+		_, err = ParseInventoryManifest([]byte(`{"fileFormat": "ORC", "fileSchema": "Key"}`))
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		// Missing data files are reported.
+		c.Expect(os.Remove(filepath.Join(dir, "two.csv")), gs.IsNil)
+		errCount := 0
+		for r := range S3InventoryIterator(context.Background(), nil, filepath.Join(dir, "manifest.json"), "data/", schema) {
+			if r.Err != nil {
+				errCount++
+				c.Expect(r.Prefix, gs.Equals, filepath.Join(dir, "manifest.json"))
+			}
+		}
+		c.Expect(errCount, gs.Equals, 1)
+
+		// The inventory must be of the bucket being listed.
+		errCount = 0
+		for r := range S3InventoryIterator(context.Background(), &s3.Bucket{Name: "dest"}, filepath.Join(dir, "manifest.json"), "data/", schema) {
+			c.Expect(r.Err, gs.Not(gs.IsNil))
+			errCount++
+		}
+		c.Expect(errCount, gs.Equals, 1)
+	})
+
+	c.Specify("Key filters", func() {
+		f, err := NewKeyFilter("", "", 0, 0)
+		c.Expect(err, gs.IsNil)
+		c.Expect(f == nil, gs.IsTrue)
+		c.Expect(f.Allowed(s3.Key{}), gs.IsTrue)
+
+		_, err = NewKeyFilter("", "", 10, 5)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = NewKeyFilter("yesterday", "", 0, 0)
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		f, err = NewKeyFilter("20151001", "2015-10-03", 1, 100)
+		c.Expect(err, gs.IsNil)
+		key := func(modified string, size int64) s3.Key {
+			return s3.Key{Key: "k", LastModified: modified, Size: size}
+		}
+		c.Expect(f.Allowed(key("2015-10-01T00:00:00.000Z", 10)), gs.IsTrue)
+		c.Expect(f.Allowed(key("2015-10-02T23:59:59.999Z", 100)), gs.IsTrue)
+		c.Expect(f.Allowed(key("2015-09-30T23:59:59.000Z", 10)), gs.IsFalse)
+		c.Expect(f.Allowed(key("2015-10-03T00:00:00.000Z", 10)), gs.IsFalse)
+		c.Expect(f.Allowed(key("2015-10-02T10:00:00.000Z", 0)), gs.IsFalse)
+		c.Expect(f.Allowed(key("2015-10-02T10:00:00.000Z", 101)), gs.IsFalse)
+		c.Expect(f.Allowed(key("", 10)), gs.IsFalse)
+
+		// Only zero-byte objects are skipped.
+		f, _ = NewKeyFilter("", "", 1, 0)
+		c.Expect(f.Allowed(key("", 1<<40)), gs.IsTrue)
+
+		results := make(chan S3ListResult, 3)
+		results <- S3ListResult{Key: key("", 0)}
+		results <- S3ListResult{Err: errors.New("oops"), Prefix: "p/"}
+		results <- S3ListResult{Key: key("", 5)}
+		close(results)
+		var passed []S3ListResult
+		for r := range FilterKeys(context.Background(), results, f) {
+			passed = append(passed, r)
+		}
+		c.Expect(len(passed), gs.Equals, 2)
+		c.Expect(passed[0].Prefix, gs.Equals, "p/")
+		c.Expect(passed[1].Key.Size, gs.Equals, int64(5))
+	})
+
+	c.Specify("Split file names", func() {
+		name, ok := ParseSplitFileName("data/main/20151001/20151001021500.123_ip-10-0-0-1")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(name.Hostname, gs.Equals, "ip-10-0-0-1")
+		c.Expect(name.Created.Equal(time.Date(2015, 10, 1, 2, 15, 0, 123000000, time.UTC)), gs.IsTrue)
+
+		// Repartitioned files keep the original name.
+		name, ok = ParseSplitFileName("20151001021500.123_ip-10-0-0-1_0a1b2c3d_2")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(name.Hostname, gs.Equals, "ip-10-0-0-1")
+		for _, part := range []int{0, 12} {
+			name, ok = ParseSplitFileName(RepartitionedFileName("data/main/20151001/20151001021500.123_ip-10-0-0-1", part))
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(name.Hostname, gs.Equals, "ip-10-0-0-1")
+		}
+
+		for _, bad := range []string{"foo", "20151001021500_host", "20151301021500.123_host", "20151001021500.123_"} {
+			_, ok = ParseSplitFileName(bad)
+			c.Expect(ok, gs.IsFalse)
+		}
+
+		f, err := NewNameFilter("", "", []string{" "})
+		c.Expect(err, gs.IsNil)
+		c.Expect(f == nil, gs.IsTrue)
+		c.Expect(f.Allowed("anything"), gs.IsTrue)
+
+		_, err = NewNameFilter("2015100103", "2015100102", nil)
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		f, err = NewNameFilter("2015100102", "2015100103", []string{"hostX"})
+		c.Expect(err, gs.IsNil)
+		c.Expect(f.Allowed("x/20151001020000.000_hostX"), gs.IsTrue)
+		c.Expect(f.Allowed("x/20151001025959.999_hostX_0a1b2c3d_0"), gs.IsTrue)
+		c.Expect(f.Allowed("x/20151001030000.000_hostX"), gs.IsFalse)
+		c.Expect(f.Allowed("x/20151001015959.999_hostX"), gs.IsFalse)
+		c.Expect(f.Allowed("x/20151001021500.000_hostY"), gs.IsFalse)
+		c.Expect(f.Allowed("x/notasplitfile"), gs.IsFalse)
+	})
+
+	c.Specify("Compression detection", func() {
+		c.Expect(DetectCompression([]byte{0x1f, 0x8b, 0x08}, "", "a"), gs.Equals, CompressionGzip)
+		c.Expect(DetectCompression([]byte{0x28, 0xb5, 0x2f, 0xfd}, "", "a"), gs.Equals, CompressionZstd)
+		c.Expect(DetectCompression([]byte("\xff\x06\x00\x00sNaPpY"), "", "a"), gs.Equals, CompressionSnappy)
+		c.Expect(DetectCompression([]byte{0x1e, 0x02}, "", "a"), gs.Equals, CompressionNone)
+		c.Expect(DetectCompression(nil, "x-gzip", "a"), gs.Equals, CompressionGzip)
+		c.Expect(DetectCompression(nil, "", "a.zst"), gs.Equals, CompressionZstd)
+		c.Expect(DetectCompression(nil, "", "a.sz"), gs.Equals, CompressionSnappy)
+		// Magic bytes take precedence.
+		c.Expect(DetectCompression([]byte{0x1f, 0x8b}, "zstd", "a.sz"), gs.Equals, CompressionGzip)
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte("uncompressed"))
+		gz.Close()
+		d, err := newDecompressor(CompressionGzip, &buf)
+		c.Expect(err, gs.IsNil)
+		data, err := ioutil.ReadAll(d)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(data), gs.Equals, "uncompressed")
+		c.Expect(d.Close(), gs.IsNil)
+
+		_, err = newDecompressor("lzma", &buf)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Record splitters", func() {
+		readAll := func(data string, offset uint64, splitter Splitter) []S3Record {
+			recordChan := make(chan S3Record, 10)
+			go func() {
+				splitRecords(context.Background(), strings.NewReader(data), "key", CompressionNone, offset, splitter, recordChan)
+				close(recordChan)
+			}()
+			records := []S3Record{}
+			for r := range recordChan {
+				if len(r.Record) > 0 {
+					records = append(records, r)
+				}
+			}
+			return records
+		}
+
+		splitter, err := NewSplitter(SplitterToken, "")
+		c.Expect(err, gs.IsNil)
+		records := readAll("{\"a\":1}\n{\"b\":2}\n{\"c\":3}", 100, splitter)
+		c.Expect(len(records), gs.Equals, 3)
+		c.Expect(string(records[0].Record), gs.Equals, "{\"a\":1}\n")
+		c.Expect(records[0].Offset, gs.Equals, uint64(100))
+		c.Expect(records[1].Offset, gs.Equals, uint64(108))
+		// The last record has no trailing newline, but is still read.
+		c.Expect(string(records[2].Record), gs.Equals, "{\"c\":3}")
+		c.Expect(records[2].Offset, gs.Equals, uint64(116))
+		c.Expect(records[2].BytesRead, gs.Equals, 7)
+
+		splitter, err = NewSplitter(SplitterWholeObject, "")
+		c.Expect(err, gs.IsNil)
+		records = readAll("line one\nline two\n", 0, splitter)
+		c.Expect(len(records), gs.Equals, 1)
+		c.Expect(string(records[0].Record), gs.Equals, "line one\nline two\n")
+
+		splitter, err = NewSplitter(SplitterHekaFraming, "")
+		c.Expect(err, gs.IsNil)
+		c.Expect(isHekaFraming(splitter), gs.IsTrue)
+		c.Expect(IsHekaFramingType(""), gs.IsTrue)
+		c.Expect(IsHekaFramingType(SplitterToken), gs.IsFalse)
+
+		// A partial message at the end of a framed stream is discarded and
+		// reported.
+		recordChan := make(chan S3Record, 10)
+		go func() {
+			splitRecords(context.Background(), strings.NewReader("\x1e\x05abc"), "key", CompressionNone, 0, splitter, recordChan)
+			close(recordChan)
+		}()
+		truncated := 0
+		for r := range recordChan {
+			if e, ok := r.Err.(TruncatedRecordError); ok {
+				c.Expect(e.Bytes, gs.Equals, 5)
+				c.Expect(r.BytesRead, gs.Equals, 5)
+				c.Expect(len(r.Record), gs.Equals, 0)
+				truncated++
+			}
+		}
+		c.Expect(truncated, gs.Equals, 1)
+
+		_, err = NewSplitter(SplitterRegex, "")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = NewSplitter("csv", "")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Schema reload", func() {
+		dir, err := ioutil.TempDir("", "schema-reload")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		schemaFile := filepath.Join(dir, "schema.json")
+		err = ioutil.WriteFile(schemaFile, []byte(`{"version": 1, "dimensions": [{"field_name": "a", "allowed_values": "*"}]}`), 0644)
+		c.Expect(err, gs.IsNil)
+
+		o := &S3SplitFileOutput{S3SplitFileOutputConfig: &S3SplitFileOutputConfig{SchemaFile: schemaFile}}
+		finalizeErr, err := o.swapSchema()
+		c.Expect(finalizeErr, gs.IsNil)
+		c.Expect(err, gs.IsNil)
+		c.Expect(o.schema.Fields[0], gs.Equals, "a")
+
+		// A schema limiting cardinality gets a new guard.
+		err = ioutil.WriteFile(schemaFile, []byte(`{"version": 1, "dimensions": [{"field_name": "b", "allowed_values": "*", "max_distinct_values": 5}]}`), 0644)
+		c.Expect(err, gs.IsNil)
+		_, err = o.swapSchema()
+		c.Expect(err, gs.IsNil)
+		c.Expect(o.schema.Fields[0], gs.Equals, "b")
+		c.Expect(o.cardinality == nil, gs.IsFalse)
+
+		// An invalid schema is rejected, keeping the old one.
+		err = ioutil.WriteFile(schemaFile, []byte(`{"version": 1, "dimensions": [`), 0644)
+		c.Expect(err, gs.IsNil)
+		_, err = o.swapSchema()
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(o.schema.Fields[0], gs.Equals, "b")
+		c.Expect(o.schemaReloadCount, gs.Equals, int64(3))
+		c.Expect(o.schemaReloadFailures, gs.Equals, int64(1))
+
+		// The result is described by a message of its own Type.
+		msg := new(message.Message)
+		setReloadMessage(msg, "S3SplitFileOutput", schemaFile, nil)
+		c.Expect(msg.GetType(), gs.Equals, schemaReloadType)
+		c.Expect(msg.GetSeverity(), gs.Equals, int32(6))
+		success, _ := msg.GetFieldValue("Success")
+		c.Expect(success, gs.Equals, true)
+		msg = new(message.Message)
+		setReloadMessage(msg, "S3SplitFileOutput", schemaFile, errors.New("bad schema"))
+		c.Expect(msg.GetSeverity(), gs.Equals, int32(3))
+		c.Expect(strings.Contains(msg.GetPayload(), "bad schema"), gs.IsTrue)
+		success, _ = msg.GetFieldValue("Success")
+		c.Expect(success, gs.Equals, false)
+
+		// Relative dates in the schema move with the clock.
+		now := time.Date(2015, 3, 2, 12, 0, 0, 0, time.UTC)
+		o.SchemaFile = filepath.Join(".", "testsupport", "schema_relative.json")
+		_, err = o.swapSchema()
+		c.Expect(err, gs.IsNil)
+		o.refreshSchema(now)
+		testFieldVal(c, o.schema, "submissionDate", "20150223", "20150223")
+		o.refreshSchema(now.AddDate(0, 0, 1))
+		testFieldVal(c, o.schema, "submissionDate", "20150223", "OTHER")
+	})
 }
@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Compression formats that ReadS3File decompresses.
+const (
+	CompressionNone   = ""
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// The stream identifier chunk that starts the snappy framing format.
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// Number of bytes needed to recognize any of the formats.
+const compressionMagicLen = 10
+
+// Work out how an S3 object is compressed, from its first few bytes, its
+// Content-Encoding or the suffix of its key, in that order of preference.
+func DetectCompression(magic []byte, contentEncoding string, key string) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressionZstd
+	case bytes.HasPrefix(magic, snappyMagic):
+		return CompressionSnappy
+	}
+	switch strings.ToLower(contentEncoding) {
+	case "gzip", "x-gzip":
+		return CompressionGzip
+	case "zstd":
+		return CompressionZstd
+	case "x-snappy-framed":
+		return CompressionSnappy
+	}
+	switch {
+	case strings.HasSuffix(key, ".gz"):
+		return CompressionGzip
+	case strings.HasSuffix(key, ".zst"):
+		return CompressionZstd
+	case strings.HasSuffix(key, ".sz"):
+		return CompressionSnappy
+	}
+	return CompressionNone
+}
+
+// Wrap a reader to decompress it. The returned reader must be closed, which
+// doesn't close the original.
+func newDecompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		return zstd.NewReader(r), nil
+	case CompressionSnappy:
+		return ioutil.NopCloser(snappy.NewReader(r)), nil
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("Unknown compression '%s'", compression)
+}
+
+// A decompressed S3 object. Closing it closes the underlying response.
+type s3ObjectReader struct {
+	io.Reader
+	decompressor io.Closer
+	body         io.Closer
+}
+
+func (r *s3ObjectReader) Close() error {
+	r.decompressor.Close()
+	return r.body.Close()
+}
+
+// Open an S3 object for reading from the given offset, decompressing it if
+// need be. The offset is in the uncompressed data. Reading from the start
+// takes a single GET. Otherwise the first few bytes of the object are fetched
+// to tell whether it's compressed: an uncompressed object is then read with a
+// ranged GET from the offset, while for a compressed one the whole object is
+// fetched and everything before the offset is read (and decompressed) and
+// skipped. Callers must call Close() on rc.
+func openS3Object(bucket *s3.Bucket, s3Key string, offset uint64) (rc io.ReadCloser, compression string, err error) {
+	if offset > 0 {
+		if compression, err = probeS3Compression(bucket, s3Key); err != nil {
+			return
+		}
+		if compression == CompressionNone {
+			headers := identityHeaders()
+			headers["Range"] = []string{fmt.Sprintf("bytes=%d-", offset)}
+			resp, err := bucket.GetResponseWithHeaders(s3Key, headers)
+			if err != nil {
+				return nil, compression, err
+			}
+			return resp.Body, compression, nil
+		}
+	}
+
+	resp, err := bucket.GetResponseWithHeaders(s3Key, identityHeaders())
+	if err != nil {
+		return
+	}
+	br := bufio.NewReader(resp.Body)
+	// A short object simply has fewer bytes to check.
+	magic, _ := br.Peek(compressionMagicLen)
+	compression = DetectCompression(magic, resp.Header.Get("Content-Encoding"), s3Key)
+	d, err := newDecompressor(compression, br)
+	if err != nil {
+		resp.Body.Close()
+		return nil, compression, err
+	}
+	rc = &s3ObjectReader{d, d, resp.Body}
+	if offset > 0 {
+		if _, err = io.CopyN(ioutil.Discard, rc, int64(offset)); err != nil {
+			rc.Close()
+			return nil, compression, fmt.Errorf("Error skipping to offset %d of %s: %s", offset, s3Key, err)
+		}
+	}
+	return rc, compression, nil
+}
+
+// Work out how an S3 object is compressed from a ranged GET of its first few
+// bytes.
+func probeS3Compression(bucket *s3.Bucket, s3Key string) (compression string, err error) {
+	headers := identityHeaders()
+	headers["Range"] = []string{fmt.Sprintf("bytes=0-%d", compressionMagicLen-1)}
+	resp, err := bucket.GetResponseWithHeaders(s3Key, headers)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	magic, err := ioutil.ReadAll(io.LimitReader(resp.Body, compressionMagicLen))
+	if err != nil {
+		return
+	}
+	return DetectCompression(magic, resp.Header.Get("Content-Encoding"), s3Key), nil
+}
+
+// Headers asking for the stored bytes of an object as they are, so that the
+// transport doesn't transparently gunzip them and hide the Content-Encoding.
+func identityHeaders() map[string][]string {
+	return map[string][]string{"Accept-Encoding": {"identity"}}
+}
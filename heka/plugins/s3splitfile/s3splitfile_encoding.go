@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+// How dimension values are turned into S3 path components.
+const (
+	// Replace unsafe characters with "_" (see SanitizeDimension). This can't
+	// be reversed.
+	EncodingSanitize = "sanitize"
+	// Replace unsafe characters (and "%") with "%XX" escapes.
+	EncodingPercent = "percent"
+	// Encode the whole value as unpadded base32.
+	EncodingBase32 = "base32"
+)
+
+// Encode a dimension value as an S3 path component.
+func EncodeDimension(encoding string, dim string) string {
+	switch encoding {
+	case EncodingPercent:
+		return PercentEncodeDimension(dim)
+	case EncodingBase32:
+		return Base32EncodeDimension(dim)
+	}
+	return SanitizeDimension(dim)
+}
+
+// Get the dimension value back from an S3 path component. Sanitized values
+// are returned unchanged, since the original value can't be recovered.
+func DecodeDimension(encoding string, encoded string) (string, error) {
+	switch encoding {
+	case EncodingPercent:
+		return PercentDecodeDimension(encoded)
+	case EncodingBase32:
+		return Base32DecodeDimension(encoded)
+	}
+	return encoded, nil
+}
+
+func isPercentSafe(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+		ch == '_' || ch == '.' || ch == '-'
+}
+
+// Escape every byte other than letters, digits, "_", "." and "-" as "%XX".
+// Unlike SanitizeDimension, "/" is escaped too, so a value never adds extra
+// levels to the path.
+func PercentEncodeDimension(dim string) string {
+	var buf []byte
+	for i := 0; i < len(dim); i++ {
+		ch := dim[i]
+		if isPercentSafe(ch) {
+			buf = append(buf, ch)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", ch)...)
+		}
+	}
+	return string(buf)
+}
+
+func unhex(ch byte) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// Reverse PercentEncodeDimension.
+func PercentDecodeDimension(encoded string) (string, error) {
+	var buf []byte
+	for i := 0; i < len(encoded); i++ {
+		ch := encoded[i]
+		if ch != '%' {
+			buf = append(buf, ch)
+			continue
+		}
+		if i+2 >= len(encoded) {
+			return "", fmt.Errorf("Invalid escape at offset %d in '%s'", i, encoded)
+		}
+		hi, okHi := unhex(encoded[i+1])
+		lo, okLo := unhex(encoded[i+2])
+		if !okHi || !okLo {
+			return "", fmt.Errorf("Invalid escape at offset %d in '%s'", i, encoded)
+		}
+		buf = append(buf, hi<<4|lo)
+		i += 2
+	}
+	return string(buf), nil
+}
+
+// Encode the whole value as base32, without padding.
+func Base32EncodeDimension(dim string) string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString([]byte(dim)), "=")
+}
+
+// Reverse Base32EncodeDimension.
+func Base32DecodeDimension(encoded string) (string, error) {
+	if pad := len(encoded) % 8; pad != 0 {
+		encoded += strings.Repeat("=", 8-pad)
+	}
+	decoded, err := base32.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// Encode a dimension value using the schema's encoding.
+func (s *Schema) EncodeDimension(dim string) string {
+	return EncodeDimension(s.Encoding, dim)
+}
+
+// Decode an S3 path component using the schema's encoding.
+func (s *Schema) DecodeDimension(encoded string) (string, error) {
+	return DecodeDimension(s.Encoding, encoded)
+}
+
+// Decode the dimension values from an S3 key (or prefix) written using this
+// schema. Any bucket prefix must already have been removed. Extra path
+// components (such as the file name) are ignored, and missing ones are
+// returned as "".
+func (s *Schema) DecodeDimensionPath(path string) (dims []string, err error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	dims = make([]string, len(s.Fields))
+	for i := range dims {
+		if i >= len(parts) {
+			break
+		}
+		if dims[i], err = s.DecodeDimension(parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return dims, nil
+}
+
+// Get the encoded form of a literal prefix of dimension values, or "" if the
+// encoding doesn't preserve prefixes.
+func (s *Schema) encodeListPrefix(prefix string) string {
+	switch s.Encoding {
+	case EncodingPercent:
+		return PercentEncodeDimension(prefix)
+	case EncodingBase32:
+		return ""
+	}
+	// S3 prefixes are sanitized, so an unsanitary literal prefix would never
+	// match anything.
+	if SanitizeDimension(prefix) != prefix {
+		return ""
+	}
+	return prefix
+}
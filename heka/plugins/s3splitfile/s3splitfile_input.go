@@ -12,6 +12,7 @@ import (
 	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
 	"io"
 	"regexp"
 	"strings"
@@ -20,6 +21,11 @@ import (
 	"time"
 )
 
+// Reads the files under an S3 bucket prefix that match a schema. A file that
+// fails part way through is read again, up to `s3_retries` times, carrying on
+// after the last record delivered. An uncompressed file is fetched from that
+// record onwards, while a compressed one (gzip, zstd or snappy) is fetched
+// from the start and decompressed again up to that record.
 type S3SplitFileInput struct {
 	processFileCount          int64
 	processFileFailures       int64
@@ -27,12 +33,17 @@ type S3SplitFileInput struct {
 	processMessageCount       int64
 	processMessageFailures    int64
 	processMessageBytes       int64
+	listPrefixFailures        int64
 
 	*S3SplitFileInputConfig
 	objectMatch *regexp.Regexp
 	bucket      *s3.Bucket
 	schema      Schema
-	stop        chan bool
+	cache       *ListingCache
+	keyFilter   *KeyFilter
+	nameFilter  *NameFilter
+	ctx         context.Context
+	cancel      context.CancelFunc
 	listChan    chan string
 }
 
@@ -53,6 +64,35 @@ type S3SplitFileInputConfig struct {
 	S3ConnectTimeout   uint32 `toml:"s3_connect_timeout"`
 	S3ReadTimeout      uint32 `toml:"s3_read_timeout"`
 	S3WorkerCount      uint32 `toml:"s3_worker_count"`
+	S3ListConcurrency  uint32 `toml:"s3_list_concurrency"`
+
+	// Directory to keep listings in between runs. Listing caching is
+	// disabled if empty.
+	ListingCacheDir string `toml:"listing_cache_dir"`
+	// Dimension holding the date of each leaf prefix.
+	ListingCacheDateField string `toml:"listing_cache_date_field"`
+	// Leaf prefixes with dates in the last `listing_cache_hot_days` days
+	// are always listed again.
+	ListingCacheHotDays uint32 `toml:"listing_cache_hot_days"`
+
+	// List keys from this S3 Inventory manifest ("s3://bucket/key" or a
+	// local path) instead of using the List API.
+	InventoryManifest string `toml:"inventory_manifest"`
+
+	// Only read objects last modified within this window, and of at least
+	// `min_size` and at most `max_size` bytes. Empty or zero values are not
+	// checked.
+	ModifiedAfter  string `toml:"modified_after"`
+	ModifiedBefore string `toml:"modified_before"`
+	MinSize        int64  `toml:"min_size"`
+	MaxSize        int64  `toml:"max_size"`
+
+	// Only read files whose names (see SplitFileName) show they were
+	// created within this window, by one of these hosts. Empty values are
+	// not checked.
+	CreatedAfter  string   `toml:"created_after"`
+	CreatedBefore string   `toml:"created_before"`
+	Hostnames     []string `toml:"hostnames"`
 }
 
 func (input *S3SplitFileInput) ConfigStruct() interface{} {
@@ -69,6 +109,10 @@ func (input *S3SplitFileInput) ConfigStruct() interface{} {
 		S3ConnectTimeout:   60,
 		S3ReadTimeout:      60,
 		S3WorkerCount:      10,
+		S3ListConcurrency:  1,
+
+		ListingCacheDateField: "submissionDate",
+		ListingCacheHotDays:   2,
 	}
 }
 
@@ -111,14 +155,33 @@ func (input *S3SplitFileInput) Init(config interface{}) (err error) {
 	// Remove any excess path separators from the bucket prefix.
 	conf.S3BucketPrefix = CleanBucketPrefix(conf.S3BucketPrefix)
 
-	input.stop = make(chan bool)
+	input.keyFilter, err = NewKeyFilter(conf.ModifiedAfter, conf.ModifiedBefore, conf.MinSize, conf.MaxSize)
+	if err != nil {
+		return fmt.Errorf("Parameters 'modified_after', 'modified_before', 'min_size' and 'max_size' must be valid: %s", err)
+	}
+
+	input.nameFilter, err = NewNameFilter(conf.CreatedAfter, conf.CreatedBefore, conf.Hostnames)
+	if err != nil {
+		return fmt.Errorf("Parameters 'created_after', 'created_before' and 'hostnames' must be valid: %s", err)
+	}
+
+	if conf.ListingCacheDir != "" && conf.S3Bucket != "" {
+		hotWindow := time.Duration(conf.ListingCacheHotDays) * 24 * time.Hour
+		input.cache, err = OpenListingCache(conf.ListingCacheDir, conf.S3Bucket, conf.S3BucketPrefix,
+			input.schema, conf.ListingCacheDateField, hotWindow)
+		if err != nil {
+			return fmt.Errorf("Parameter 'listing_cache_dir': %s", err)
+		}
+	}
+
+	input.ctx, input.cancel = context.WithCancel(context.Background())
 	input.listChan = make(chan string, 1000)
 
 	return nil
 }
 
 func (input *S3SplitFileInput) Stop() {
-	close(input.stop)
+	input.cancel()
 }
 
 func (input *S3SplitFileInput) Run(runner pipeline.InputRunner, helper pipeline.PluginHelper) error {
@@ -130,22 +193,38 @@ func (input *S3SplitFileInput) Run(runner pipeline.InputRunner, helper pipeline.
 	//   - write them to a "reader" channel
 
 	var (
-		wg sync.WaitGroup
-		i  uint32
+		wg             sync.WaitGroup
+		i              uint32
+		failedPrefixes []string
 	)
 
 	wg.Add(1)
 	go func() {
 		runner.LogMessage("Starting S3 list")
+		// Evaluate any relative dates in the schema as of this listing pass.
+		input.schema.Refresh(time.Now().UTC())
+		var listing <-chan S3ListResult
+		if input.InventoryManifest != "" {
+			listing = S3InventoryIterator(input.ctx, input.bucket, input.InventoryManifest,
+				input.S3BucketPrefix, input.schema)
+		} else {
+			listing = S3CachedIterator(input.ctx, input.bucket, input.S3BucketPrefix, input.schema,
+				int(input.S3ListConcurrency), input.cache)
+		}
+		filtered := FilterNames(input.ctx, FilterKeys(input.ctx, listing, input.keyFilter), input.nameFilter)
 	iteratorLoop:
-		for r := range S3Iterator(input.bucket, input.S3BucketPrefix, input.schema) {
+		for r := range filtered {
 			select {
-			case <-input.stop:
+			case <-input.ctx.Done():
 				runner.LogMessage("Stopping S3 list")
 				break iteratorLoop
 			default:
 			}
-			if r.Err != nil {
+			if r.Err != nil && r.Prefix != "" {
+				runner.LogError(fmt.Errorf("Error listing S3 prefix %s: %s", r.Prefix, r.Err))
+				atomic.AddInt64(&input.listPrefixFailures, 1)
+				failedPrefixes = append(failedPrefixes, r.Prefix)
+			} else if r.Err != nil {
 				runner.LogError(fmt.Errorf("Error getting S3 list: %s", r.Err))
 			} else {
 				basename := r.Key.Key[strings.LastIndex(r.Key.Key, "/")+1:]
@@ -157,6 +236,14 @@ func (input *S3SplitFileInput) Run(runner pipeline.InputRunner, helper pipeline.
 				}
 			}
 		}
+		if input.cache != nil {
+			// Wait for the listing to finish before saving it.
+			for _ = range listing {
+			}
+			if err := input.cache.Save(); err != nil {
+				runner.LogError(fmt.Errorf("Error saving listing cache: %s", err))
+			}
+		}
 		// All done listing, close the channel
 		runner.LogMessage("All done listing. Closing channel")
 		close(input.listChan)
@@ -170,26 +257,49 @@ func (input *S3SplitFileInput) Run(runner pipeline.InputRunner, helper pipeline.
 	}
 	wg.Wait()
 
+	if len(failedPrefixes) > 0 {
+		return fmt.Errorf("Failed to list %d S3 prefixes: %s", len(failedPrefixes), strings.Join(failedPrefixes, ", "))
+	}
 	return nil
 }
 
 // TODO: handle "no such file"
-func (input *S3SplitFileInput) readS3File(runner pipeline.InputRunner, d *pipeline.Deliverer, sr *pipeline.SplitterRunner, s3Key string) (err error) {
+func (input *S3SplitFileInput) readS3File(runner pipeline.InputRunner, d *pipeline.Deliverer, fetcherName string, s3Key string) (err error) {
 	runner.LogMessage(fmt.Sprintf("Preparing to read: %s", s3Key))
 	if input.bucket == nil {
 		runner.LogMessage(fmt.Sprintf("Dude, where's my bucket: %s", s3Key))
 		return
 	}
 
+	// A fresh instance of the configured splitter, with its section's
+	// settings, so nothing carries over from another file. Each attempt
+	// splits with its own buffer, and the records are in the form
+	// DeliverRecord expects.
+	sr := runner.NewSplitterRunner(fetcherName)
+	defer sr.Done()
+
 	var lastGoodOffset uint64
 	var attempt uint32
 
 RetryS3:
 	for attempt = 1; attempt <= input.S3Retries; attempt++ {
-		for r := range S3FileIterator(input.bucket, s3Key, lastGoodOffset) {
+		for r := range S3FileIteratorWithSplitter(input.ctx, input.bucket, s3Key, lastGoodOffset, sr.Splitter()) {
 			record := r.Record
 			err := r.Err
 
+			if e, ok := err.(TruncatedRecordError); ok {
+				atomic.AddInt64(&input.processFileDiscardedBytes, int64(e.Bytes))
+				runner.LogError(fmt.Errorf("Trailing data, possible corruption: %d bytes left in stream at EOF: %s", e.Bytes, s3Key))
+				continue
+			}
+			if _, ok := err.(RecordTooLargeError); ok {
+				// Reading the file again would only hit the same record, so
+				// skip past it.
+				lastGoodOffset += uint64(r.BytesRead)
+				atomic.AddInt64(&input.processMessageFailures, 1)
+				runner.LogError(fmt.Errorf("Skipping record in %s at offset %d: %s", s3Key, r.Offset, err))
+				continue
+			}
 			if err != nil && err != io.EOF {
 				runner.LogError(fmt.Errorf("Error in attempt %d reading %s at offset %d: %s", attempt, s3Key, lastGoodOffset, err))
 				atomic.AddInt64(&input.processMessageFailures, 1)
@@ -199,13 +309,14 @@ RetryS3:
 				lastGoodOffset += uint64(r.BytesRead)
 				atomic.AddInt64(&input.processMessageCount, 1)
 				atomic.AddInt64(&input.processMessageBytes, int64(len(record)))
-				(*sr).DeliverRecord(record, *d)
+				sr.DeliverRecord(record, *d)
 			}
 		}
 		break
 	}
 
-	return
+	// The file is incomplete if we were stopped part way through.
+	return input.ctx.Err()
 }
 
 func (input *S3SplitFileInput) fetcher(runner pipeline.InputRunner, wg *sync.WaitGroup, workerId uint32) {
@@ -218,7 +329,6 @@ func (input *S3SplitFileInput) fetcher(runner pipeline.InputRunner, wg *sync.Wai
 	fetcherName := fmt.Sprintf("S3Reader%d", workerId)
 	deliverer := runner.NewDeliverer(fetcherName)
 	defer deliverer.Done()
-	splitterRunner := runner.NewSplitterRunner(fetcherName)
 
 	ok := true
 	for ok {
@@ -231,14 +341,8 @@ func (input *S3SplitFileInput) fetcher(runner pipeline.InputRunner, wg *sync.Wai
 			}
 
 			startTime = time.Now().UTC()
-			err := input.readS3File(runner, &deliverer, &splitterRunner, s3Key)
+			err := input.readS3File(runner, &deliverer, fetcherName, s3Key)
 			atomic.AddInt64(&input.processFileCount, 1)
-			leftovers := splitterRunner.GetRemainingData()
-			lenLeftovers := len(leftovers)
-			if lenLeftovers > 0 {
-				atomic.AddInt64(&input.processFileDiscardedBytes, int64(lenLeftovers))
-				runner.LogError(fmt.Errorf("Trailing data, possible corruption: %d bytes left in stream at EOF: %s", lenLeftovers, s3Key))
-			}
 			if err != nil && err != io.EOF {
 				runner.LogError(fmt.Errorf("Error reading %s: %s", s3Key, err))
 				atomic.AddInt64(&input.processFileFailures, 1)
@@ -246,7 +350,7 @@ func (input *S3SplitFileInput) fetcher(runner pipeline.InputRunner, wg *sync.Wai
 			}
 			duration = time.Now().UTC().Sub(startTime).Seconds()
 			runner.LogMessage(fmt.Sprintf("Successfully fetched %s in %.2fs ", s3Key, duration))
-		case <-input.stop:
+		case <-input.ctx.Done():
 			for _ = range input.listChan {
 				// Drain the channel without processing the files.
 				// Technically the S3Iterator can still add one back on to the
@@ -266,6 +370,7 @@ func (input *S3SplitFileInput) ReportMsg(msg *message.Message) error {
 	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&input.processMessageCount), "count")
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&input.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageBytes", atomic.LoadInt64(&input.processMessageBytes), "B")
+	message.NewInt64Field(msg, "ListPrefixFailures", atomic.LoadInt64(&input.listPrefixFailures), "count")
 
 	return nil
 }
@@ -0,0 +1,262 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A data file listed in an S3 Inventory manifest.
+type InventoryFile struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	MD5Checksum string `json:"MD5checksum"`
+}
+
+// The manifest.json of an S3 Inventory report.
+type InventoryManifest struct {
+	SourceBucket      string          `json:"sourceBucket"`
+	DestinationBucket string          `json:"destinationBucket"`
+	FileFormat        string          `json:"fileFormat"`
+	FileSchema        string          `json:"fileSchema"`
+	Files             []InventoryFile `json:"files"`
+}
+
+// Get the name of the bucket holding the report's data files.
+func (m *InventoryManifest) DestinationBucketName() string {
+	// The destination is given as an ARN, "arn:aws:s3:::name".
+	return m.DestinationBucket[strings.LastIndex(m.DestinationBucket, ":")+1:]
+}
+
+// Get the index of each column of the report's data files.
+func (m *InventoryManifest) Columns() map[string]int {
+	columns := map[string]int{}
+	for i, name := range strings.Split(m.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	return columns
+}
+
+// Parse an S3 Inventory manifest. Only CSV reports are supported.
+func ParseInventoryManifest(data []byte) (m InventoryManifest, err error) {
+	if err = json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("Invalid inventory manifest: %s", err)
+	}
+	if m.FileFormat != "CSV" {
+		return m, fmt.Errorf("Unsupported inventory format '%s'", m.FileFormat)
+	}
+	columns := m.Columns()
+	if _, ok := columns["Key"]; !ok {
+		return m, fmt.Errorf("Inventory schema '%s' has no Key column", m.FileSchema)
+	}
+	return m, nil
+}
+
+// Reads the manifest and data files of an S3 Inventory report, either from
+// S3 or from a local copy.
+type inventoryReader struct {
+	bucket   *s3.Bucket
+	manifest string
+	local    bool
+}
+
+func newInventoryReader(bucket *s3.Bucket, manifest string) *inventoryReader {
+	return &inventoryReader{bucket, manifest, !strings.HasPrefix(manifest, "s3://")}
+}
+
+// Callers must call Close() on rc.
+func (r *inventoryReader) open(bucketName, key string) (rc io.ReadCloser, err error) {
+	if r.local {
+		return os.Open(key)
+	}
+	if r.bucket == nil {
+		return nil, fmt.Errorf("No S3 connection to read s3://%s/%s", bucketName, key)
+	}
+	return r.bucket.S3.Bucket(bucketName).GetReader(key)
+}
+
+func (r *inventoryReader) readManifest() (m InventoryManifest, err error) {
+	var rc io.ReadCloser
+	if r.local {
+		rc, err = r.open("", r.manifest)
+	} else {
+		// s3://bucket/key
+		location := strings.TrimPrefix(r.manifest, "s3://")
+		slash := strings.Index(location, "/")
+		if slash < 0 {
+			return m, fmt.Errorf("Invalid inventory manifest location '%s'", r.manifest)
+		}
+		rc, err = r.open(location[:slash], location[slash+1:])
+	}
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return
+	}
+	return ParseInventoryManifest(data)
+}
+
+// Open one of the report's data files. A local copy of a report may have the
+// data files alongside the manifest, or in a "data" directory next to the
+// manifest's directory as S3 lays them out.
+func (r *inventoryReader) openDataFile(m InventoryManifest, file InventoryFile) (io.ReadCloser, error) {
+	if !r.local {
+		return r.open(m.DestinationBucketName(), file.Key)
+	}
+	dir := filepath.Dir(r.manifest)
+	candidates := []string{
+		filepath.Join(dir, path.Base(file.Key)),
+		filepath.Join(filepath.Dir(dir), "data", path.Base(file.Key)),
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return r.open("", candidate)
+		}
+	}
+	return nil, fmt.Errorf("Inventory data file %s not found next to %s", path.Base(file.Key), r.manifest)
+}
+
+// Read the keys in an inventory data file, which may be gzipped, sending any
+// that match the schema to the channel. Returns false if the context was
+// cancelled.
+func readInventoryData(ctx context.Context, rc io.Reader, columns map[string]int, prefix string, schema Schema, kc chan S3ListResult) (bool, error) {
+	br := bufio.NewReader(rc)
+	var reader io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return true, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	cr := csv.NewReader(reader)
+	cr.FieldsPerRecord = -1
+	column := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	for {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		row, err := cr.Read()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		// Skip old versions and deletions in reports of versioned buckets.
+		if column(row, "IsLatest") == "false" || column(row, "IsDeleteMarker") == "true" {
+			continue
+		}
+		key, err := url.QueryUnescape(column(row, "Key"))
+		if err != nil || !InventoryKeyAllowed(key, prefix, schema) {
+			continue
+		}
+		k := s3.Key{
+			Key:          key,
+			ETag:         column(row, "ETag"),
+			LastModified: column(row, "LastModifiedDate"),
+			StorageClass: column(row, "StorageClass"),
+		}
+		k.Size, _ = strconv.ParseInt(column(row, "Size"), 10, 64)
+		if !sendListResult(ctx, kc, S3ListResult{Key: k}) {
+			return false, nil
+		}
+	}
+}
+
+// Check whether a key would be found by listing the given prefix of a bucket
+// with the schema: it must be directly under a leaf prefix, and each of its
+// dimensions must be allowed.
+func InventoryKeyAllowed(key, prefix string, schema Schema) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	rest := key[len(prefix):]
+	if strings.Count(rest, "/") != len(schema.Fields) {
+		return false
+	}
+	dims, err := schema.DecodeDimensionPath(rest)
+	if err != nil {
+		return false
+	}
+	for i, field := range schema.Fields {
+		if checker, ok := schema.Dims[field]; ok && !checker.IsAllowed(dims[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// List the keys of the given bucket prefix that match the schema from an S3
+// Inventory report instead of the List API. The manifest is either an
+// "s3://bucket/key" location, read using the bucket's connection, or a local
+// path. Keys are sent in the order they appear in the report. An error
+// reading any data file is sent on the channel, and the rest of the files are
+// still read. Errors have the manifest as their Prefix. A manifest for a
+// different bucket than the given one is rejected.
+func S3InventoryIterator(ctx context.Context, bucket *s3.Bucket, manifest string, prefix string, schema Schema) <-chan S3ListResult {
+	keyChannel := make(chan S3ListResult, listBatchSize)
+	go func() {
+		defer close(keyChannel)
+
+		r := newInventoryReader(bucket, manifest)
+		m, err := r.readManifest()
+		if err == nil && bucket != nil && m.SourceBucket != bucket.Name {
+			err = fmt.Errorf("Inventory is of bucket '%s', not '%s'", m.SourceBucket, bucket.Name)
+		}
+		if err != nil {
+			sendListResult(ctx, keyChannel, S3ListResult{Prefix: manifest, Err: err})
+			return
+		}
+		columns := m.Columns()
+		for _, file := range m.Files {
+			rc, err := r.openDataFile(m, file)
+			if err != nil {
+				if !sendListResult(ctx, keyChannel, S3ListResult{Prefix: manifest, Err: err}) {
+					return
+				}
+				continue
+			}
+			ok, err := readInventoryData(ctx, rc, columns, prefix, schema, keyChannel)
+			rc.Close()
+			if !ok {
+				return
+			}
+			if err != nil {
+				err = fmt.Errorf("Error reading inventory data file %s: %s", file.Key, err)
+				if !sendListResult(ctx, keyChannel, S3ListResult{Prefix: manifest, Err: err}) {
+					return
+				}
+			}
+		}
+	}()
+	return keyChannel
+}
@@ -0,0 +1,106 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Limits on the metadata of listed keys. Zero values are not checked.
+type KeyFilter struct {
+	// Keys last modified at or after this time.
+	ModifiedAfter time.Time
+	// Keys last modified before this time.
+	ModifiedBefore time.Time
+	// Keys of at least this many bytes.
+	MinSize int64
+	// Keys of at most this many bytes.
+	MaxSize int64
+}
+
+// Create a KeyFilter. The times may be dates in any of the layouts understood
+// by ParseDate, relative dates such as "today-1d", or "" for no limit. If
+// there are no limits at all, nil is returned, which is safe to use as a
+// filter that allows everything.
+func NewKeyFilter(modifiedAfter, modifiedBefore string, minSize, maxSize int64) (f *KeyFilter, err error) {
+	if modifiedAfter == "" && modifiedBefore == "" && minSize <= 0 && maxSize <= 0 {
+		return nil, nil
+	}
+	if minSize < 0 || maxSize < 0 || (maxSize > 0 && minSize > maxSize) {
+		return nil, fmt.Errorf("Invalid size range %d to %d", minSize, maxSize)
+	}
+	f = &KeyFilter{MinSize: minSize, MaxSize: maxSize}
+	now := time.Now().UTC()
+	if modifiedAfter != "" {
+		if f.ModifiedAfter, err = ParseDate(ResolveRelativeDate(modifiedAfter, now)); err != nil {
+			return nil, err
+		}
+	}
+	if modifiedBefore != "" {
+		if f.ModifiedBefore, err = ParseDate(ResolveRelativeDate(modifiedBefore, now)); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Check whether a key is within the filter's limits. Keys without a valid
+// LastModified time never match a time limit.
+func (f *KeyFilter) Allowed(k s3.Key) bool {
+	if f == nil {
+		return true
+	}
+	if f.MinSize > 0 && k.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && k.Size > f.MaxSize {
+		return false
+	}
+	if f.ModifiedAfter.IsZero() && f.ModifiedBefore.IsZero() {
+		return true
+	}
+	modified, err := time.Parse(time.RFC3339, k.LastModified)
+	if err != nil {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && modified.Before(f.ModifiedAfter) {
+		return false
+	}
+	if !f.ModifiedBefore.IsZero() && !modified.Before(f.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// Pass on the listed keys allowed by the filter, along with any errors. Works
+// with any listing, such as S3CachedIterator or S3InventoryIterator.
+func FilterKeys(ctx context.Context, results <-chan S3ListResult, f *KeyFilter) <-chan S3ListResult {
+	if f == nil {
+		return results
+	}
+	return filterResults(ctx, results, f.Allowed)
+}
+
+// Pass on the errors and the keys for which `allowed` returns true.
+func filterResults(ctx context.Context, results <-chan S3ListResult, allowed func(s3.Key) bool) <-chan S3ListResult {
+	keyChannel := make(chan S3ListResult, listBatchSize)
+	go func() {
+		defer close(keyChannel)
+		for r := range results {
+			if r.Err == nil && !allowed(r.Key) {
+				continue
+			}
+			if !sendListResult(ctx, keyChannel, r) {
+				return
+			}
+		}
+	}()
+	return keyChannel
+}
@@ -0,0 +1,213 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A key as recorded in a ListingCache.
+type CachedKey struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// The on-disk form of a ListingCache.
+type listingCacheFile struct {
+	Bucket   string                 `json:"bucket"`
+	Prefix   string                 `json:"prefix"`
+	Fields   []string               `json:"fields"`
+	Encoding string                 `json:"encoding"`
+	Prefixes map[string][]CachedKey `json:"prefixes"`
+
+	// Absent from caches written before intermediate prefixes were kept.
+	Subprefixes map[string][]string `json:"subprefixes"`
+}
+
+// Keys found under each leaf prefix (one with a value for every dimension) of
+// a schema's layout in a bucket, and the prefixes found under each prefix
+// below the date dimension, kept on disk between listings. Prefixes whose
+// date dimension is within the hot window, or that are above it, are always
+// listed again; the rest are only listed if they aren't in the cache, so a
+// cold date needs no List requests at all. Safe for concurrent use.
+type ListingCache struct {
+	path      string
+	bucket    string
+	prefix    string
+	schema    Schema
+	dateIndex int
+	hotWindow time.Duration
+
+	lock        sync.Mutex
+	prefixes    map[string][]CachedKey
+	subprefixes map[string][]string
+	dirty       bool
+}
+
+// Open the listing cache in `dir` for the given bucket, bucket prefix and
+// schema. The cache is keyed by the schema's layout (its field names and
+// encoding) rather than its allowed values, so it can be shared by schemas
+// selecting different parts of the same tree. Leaf prefixes are hot if the
+// day starting at the value of their `dateField` dimension is within
+// `hotWindow` of the time of the lookup.
+func OpenListingCache(dir string, bucket string, prefix string, schema Schema, dateField string, hotWindow time.Duration) (*ListingCache, error) {
+	c := &ListingCache{
+		bucket:    bucket,
+		prefix:    prefix,
+		schema:    schema,
+		dateIndex: -1,
+		hotWindow: hotWindow,
+		prefixes:  map[string][]CachedKey{},
+
+		subprefixes: map[string][]string{},
+	}
+	for i, field := range schema.Fields {
+		if field == dateField {
+			c.dateIndex = i
+		}
+	}
+	if c.dateIndex < 0 {
+		return nil, fmt.Errorf("Schema has no '%s' dimension", dateField)
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s", bucket, prefix, strings.Join(schema.Fields, "/"), schema.Encoding)
+	c.path = filepath.Join(dir, fmt.Sprintf("%s-%x.json", bucket, h.Sum(nil)))
+
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f listingCacheFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Invalid listing cache %s: %s", c.path, err)
+	}
+	if f.Bucket == bucket && f.Prefix == prefix && f.Encoding == schema.Encoding &&
+		strings.Join(f.Fields, "/") == strings.Join(schema.Fields, "/") && f.Prefixes != nil {
+		c.prefixes = f.Prefixes
+		if f.Subprefixes != nil {
+			c.subprefixes = f.Subprefixes
+		}
+	}
+	return c, nil
+}
+
+// Get the value of the date dimension of the given prefix, if it goes that
+// far.
+func (c *ListingCache) prefixDate(prefix string) (date time.Time, ok bool) {
+	dims, err := c.schema.DecodeDimensionPath(strings.TrimPrefix(prefix, c.prefix))
+	if err != nil {
+		return date, false
+	}
+	date, err = ParseDate(dims[c.dateIndex])
+	return date, err == nil
+}
+
+// Check whether the given prefix should be listed again as of `now`. Prefixes
+// without a date are always listed again.
+func (c *ListingCache) isHot(prefix string, now time.Time) bool {
+	date, ok := c.prefixDate(prefix)
+	return !ok || date.Add(24*time.Hour).After(now.Add(-c.hotWindow))
+}
+
+// Get the cached keys for a leaf prefix. Returns false if the prefix is hot as
+// of `now`, which should be the start of the current listing, or hasn't been
+// listed before.
+func (c *ListingCache) Lookup(leafPrefix string, now time.Time) (keys []s3.Key, ok bool) {
+	if c.isHot(leafPrefix, now) {
+		return nil, false
+	}
+	c.lock.Lock()
+	cached, ok := c.prefixes[leafPrefix]
+	c.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	keys = make([]s3.Key, len(cached))
+	for i, k := range cached {
+		keys[i] = s3.Key{Key: k.Key, Size: k.Size, ETag: k.ETag, LastModified: k.LastModified}
+	}
+	return keys, true
+}
+
+// Get the cached prefixes found under a prefix below the date dimension.
+// Returns false as for Lookup.
+func (c *ListingCache) LookupPrefixes(prefix string, now time.Time) (prefixes []string, ok bool) {
+	if c.isHot(prefix, now) {
+		return nil, false
+	}
+	c.lock.Lock()
+	prefixes, ok = c.subprefixes[prefix]
+	c.lock.Unlock()
+	return prefixes, ok
+}
+
+// Record the prefixes found by completely listing a prefix. Only those below
+// the date dimension are kept, since the others are always listed again.
+func (c *ListingCache) StorePrefixes(prefix string, prefixes []string) {
+	if _, ok := c.prefixDate(prefix); !ok {
+		return
+	}
+	c.lock.Lock()
+	c.subprefixes[prefix] = append([]string{}, prefixes...)
+	c.dirty = true
+	c.lock.Unlock()
+}
+
+// Record the complete listing of a leaf prefix.
+func (c *ListingCache) Store(leafPrefix string, keys []s3.Key) {
+	cached := make([]CachedKey, len(keys))
+	for i, k := range keys {
+		cached[i] = CachedKey{k.Key, k.Size, k.ETag, k.LastModified}
+	}
+	c.lock.Lock()
+	c.prefixes[leafPrefix] = cached
+	c.dirty = true
+	c.lock.Unlock()
+}
+
+// Write the cache back to disk if anything has changed.
+func (c *ListingCache) Save() (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(listingCacheFile{c.bucket, c.prefix, c.schema.Fields, c.schema.Encoding, c.prefixes, c.subprefixes})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so an interrupted save can't leave a
+	// truncated cache behind.
+	tmp := c.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,283 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers whose values are numbers in a message_matcher.
+var numericHeaders = map[string]struct{}{
+	"Severity": struct{}{},
+	"Pid":      struct{}{},
+}
+
+// Build a Heka message_matcher expression that accepts the messages whose
+// dimensions are allowed by this schema, so that filters downstream can use
+// the same selection as S3SplitFileInput. Lists, ranges, patterns and
+// exclusions are supported. Wildcard ("*") dimensions don't add a condition,
+// and a schema with only wildcards gives "TRUE".
+//
+// Unless the schema uses a reversible encoding, the schema compares the
+// sanitized form of a value (see SanitizeDimension) with the list, so list
+// values containing "_" become patterns that accept any character sanitizing
+// to "_" in its place. Dimensions with a transform, computed dimensions (other
+// than wildcards and single values selected by a field address), and typed
+// ranges can't be expressed as a matcher and result in an error, except for
+// numeric ranges on the Severity and Pid headers and date ranges on the
+// Timestamp header, which is converted to nanosecond bounds covering whole
+// days (UTC). Untyped ranges compare strings, as the schema does. Relative
+// dates are resolved as of the last Refresh.
+func (s *Schema) ToMatcher() (string, error) {
+	var clauses []string
+	for _, field := range s.Fields {
+		checker, ok := s.Dims[field]
+		if !ok {
+			return "", fmt.Errorf("No such field: '%s'", field)
+		}
+		if _, ok := checker.(AnyDimensionChecker); ok {
+			continue
+		}
+		if _, ok := s.Transforms[field]; ok {
+			return "", fmt.Errorf("Field '%s' has a transform, which can't be expressed as a matcher", field)
+		}
+		m := matcherVariable{name: fmt.Sprintf("Fields[%s]", field)}
+		if computed, ok := s.Computed[field]; ok {
+			// Only selecting a single value of a field can be expressed.
+			fs, ok := computed.(*FieldSelector)
+			if !ok || fs.MultiValue != MultiValueFirst {
+				return "", fmt.Errorf("Field '%s' is computed, so can't be expressed as a matcher", field)
+			}
+			arrayIndex := fs.ArrayIndex
+			if arrayIndex < 0 {
+				arrayIndex = 0
+			}
+			m.name = fmt.Sprintf("Fields[%s][%d][%d]", fs.Name, fs.FieldIndex, arrayIndex)
+		} else if _, ok := s.HeaderIndices[field]; ok {
+			m.name = field
+			_, m.numeric = numericHeaders[field]
+			m.timestamp = field == "Timestamp"
+		} else if strings.ContainsAny(field, "[]") {
+			return "", fmt.Errorf("Field name '%s' can't be used in a matcher", field)
+		}
+		clause, err := m.clause(checker, false)
+		if err != nil {
+			return "", fmt.Errorf("Field '%s': %s", field, err)
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(clauses, " && "), nil
+}
+
+// A message header or field as it appears in a message_matcher.
+type matcherVariable struct {
+	name string
+	// Compare against numbers rather than strings.
+	numeric bool
+	// The schema sees dates ("YYYYMMDD"), but the matcher sees nanoseconds.
+	timestamp bool
+}
+
+// Build the condition for the given checker, or for its negation.
+func (m matcherVariable) clause(checker DimensionChecker, negate bool) (string, error) {
+	switch c := checker.(type) {
+	case *ListDimensionChecker:
+		values, _ := c.ListValues()
+		op := "=="
+		if negate {
+			op = "!="
+		}
+		var terms []string
+		for _, v := range values {
+			var term string
+			var err error
+			if m.timestamp {
+				term, err = m.dayTerm(v, negate)
+			} else if !c.exact && !m.numeric && strings.Contains(v, "_") {
+				term = m.sanitizedTerm(v, negate)
+			} else {
+				term, err = m.compareTerm(op, v)
+			}
+			if err != nil {
+				return "", err
+			}
+			terms = append(terms, term)
+		}
+		return joinTerms(terms, negate), nil
+	case *RangeDimensionChecker:
+		return m.rangeClause(c, negate)
+	case *PatternDimensionChecker:
+		if m.numeric || m.timestamp {
+			return "", fmt.Errorf("Patterns can't be used with the %s header in a matcher", m.name)
+		}
+		op := "=~"
+		if negate {
+			op = "!~"
+		}
+		return fmt.Sprintf("%s %s /%s/", m.name, op, escapeMatcherRegex(c.pattern.String())), nil
+	case *NotDimensionChecker:
+		return m.clause(c.excluded, !negate)
+	}
+	return "", fmt.Errorf("Unsupported allowed values")
+}
+
+func (m matcherVariable) rangeClause(rdc *RangeDimensionChecker, negate bool) (string, error) {
+	// The matcher can only compare the way the schema does if the type of
+	// the range is the type of the variable.
+	switch {
+	case rdc.rangeType == "version":
+		return "", fmt.Errorf("Version ranges can't be expressed as a matcher")
+	case m.timestamp:
+	case m.numeric && rdc.rangeType != "numeric":
+		return "", fmt.Errorf("Only numeric ranges can be used with the %s header in a matcher", m.name)
+	case !m.numeric && rdc.rangeType != "":
+		return "", fmt.Errorf("Ranges of type '%s' can't be expressed as a matcher for %s", rdc.rangeType, m.name)
+	}
+	min, max := rdc.min, rdc.max
+	var err error
+	if m.timestamp {
+		// The range applies to whole days.
+		if min != "" {
+			if min, err = dayNanos(min, 0); err != nil {
+				return "", err
+			}
+		}
+		if max != "" {
+			if max, err = dayNanos(max, 1); err != nil {
+				return "", err
+			}
+		}
+	}
+	if m.timestamp {
+		m.numeric = true
+	}
+	// The max bound is exclusive for timestamps, inclusive otherwise.
+	ops := [4]string{">=", "<=", "<", ">"}
+	if m.timestamp {
+		ops[1], ops[3] = "<", ">="
+	}
+	if negate {
+		ops[0], ops[1] = ops[2], ops[3]
+	}
+	var terms []string
+	for i, bound := range []string{min, max} {
+		if bound == "" {
+			continue
+		}
+		term, err := m.compareTerm(ops[i], bound)
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		if negate {
+			return "FALSE", nil
+		}
+		return "TRUE", nil
+	}
+	return joinTerms(terms, !negate), nil
+}
+
+// Build the condition for a timestamp falling (or not) on the given day.
+func (m matcherVariable) dayTerm(day string, negate bool) (string, error) {
+	start, err := dayNanos(day, 0)
+	if err != nil {
+		return "", err
+	}
+	end, _ := dayNanos(day, 1)
+	if negate {
+		return fmt.Sprintf("(%s < %s || %s >= %s)", m.name, start, m.name, end), nil
+	}
+	return fmt.Sprintf("(%s >= %s && %s < %s)", m.name, start, m.name, end), nil
+}
+
+func (m matcherVariable) compareTerm(op string, value string) (string, error) {
+	if m.numeric {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", fmt.Errorf("Value '%s' is not a number", value)
+		}
+		return fmt.Sprintf("%s %s %s", m.name, op, value), nil
+	}
+	quoted, err := quoteMatcherString(value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", m.name, op, quoted), nil
+}
+
+// Characters that SanitizeDimension replaces with "_", along with "_" itself.
+const sanitizedCharClass = `[^a-zA-Z0-9\/.]`
+
+// Build the condition for a value matching (or not) a sanitized list value
+// containing "_".
+func (m matcherVariable) sanitizedTerm(value string, negate bool) string {
+	parts := strings.Split(value, "_")
+	for i, p := range parts {
+		parts[i] = escapeMatcherRegex(regexp.QuoteMeta(p))
+	}
+	op := "=~"
+	if negate {
+		op = "!~"
+	}
+	return fmt.Sprintf("%s %s /^%s$/", m.name, op, strings.Join(parts, sanitizedCharClass))
+}
+
+// Get the start of the day containing the given date, plus `days` days, as
+// nanoseconds since the epoch.
+func dayNanos(date string, days int) (string, error) {
+	t, err := ParseDate(date)
+	if err != nil {
+		return "", err
+	}
+	t = t.UTC().Truncate(24*time.Hour).AddDate(0, 0, days)
+	return strconv.FormatInt(t.UnixNano(), 10), nil
+}
+
+// Join alternatives with "||" (or, if `all` is set, requirements with "&&").
+func joinTerms(terms []string, all bool) string {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	if all {
+		return "(" + strings.Join(terms, " && ") + ")"
+	}
+	return "(" + strings.Join(terms, " || ") + ")"
+}
+
+func quoteMatcherString(v string) (string, error) {
+	if !strings.Contains(v, "'") {
+		return "'" + v + "'", nil
+	}
+	if !strings.Contains(v, "\"") {
+		return "\"" + v + "\"", nil
+	}
+	return "", fmt.Errorf("Value '%s' can't be quoted in a matcher", v)
+}
+
+// Escape any unescaped slashes, which would otherwise end the regular
+// expression literal.
+func escapeMatcherRegex(pattern string) string {
+	var buf []byte
+	escaped := false
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		if ch == '/' && !escaped {
+			buf = append(buf, '\\')
+		}
+		escaped = ch == '\\' && !escaped
+		buf = append(buf, ch)
+	}
+	return string(buf)
+}
@@ -0,0 +1,137 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"golang.org/x/net/context"
+	"hash/crc32"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Layout of the creation time at the start of the files written by
+// S3SplitFileOutput, which are named "<time>_<hostname>".
+const SplitFileTimeLayout = "20060102150405.000"
+
+// The suffix RepartitionedFileName appends to the original name, which
+// ParseSplitFileName ignores.
+const repartitionSuffixPattern = `_[0-9a-f]{8}_[0-9]+`
+
+var splitFileNamePattern = regexp.MustCompile(`^([0-9]{14}\.[0-9]{3})_(.+?)(?:` + repartitionSuffixPattern + `)?$`)
+
+// Get the name of a part of a file rewritten by heka-s3repartition. It's the
+// name of the original file, with a hash of its full key (to tell apart files
+// of the same name from different partitions) and the part number appended.
+func RepartitionedFileName(s3Key string, part int) string {
+	return fmt.Sprintf("%s_%08x_%d", path.Base(s3Key), crc32.ChecksumIEEE([]byte(s3Key)), part)
+}
+
+// The parts of the name of a file written by S3SplitFileOutput.
+type SplitFileName struct {
+	Created  time.Time
+	Hostname string
+}
+
+// Parse the base name of an S3 key written by S3SplitFileOutput (or rewritten
+// by heka-s3repartition). Returns false if the name doesn't follow that
+// convention.
+func ParseSplitFileName(key string) (name SplitFileName, ok bool) {
+	m := splitFileNamePattern.FindStringSubmatch(path.Base(key))
+	if m == nil {
+		return name, false
+	}
+	created, err := time.Parse(SplitFileTimeLayout, m[1])
+	if err != nil {
+		return name, false
+	}
+	return SplitFileName{created, m[2]}, true
+}
+
+// Limits on the creation time and host in the names of split files. Zero
+// values are not checked.
+type NameFilter struct {
+	// Files created at or after this time.
+	CreatedAfter time.Time
+	// Files created before this time.
+	CreatedBefore time.Time
+	// Files created by any of these hosts.
+	Hostnames map[string]struct{}
+}
+
+// Create a NameFilter. The times may be in any of the layouts understood by
+// ParseDate, relative dates such as "today", or "" for no limit. If there are
+// no limits at all, nil is returned, which is safe to use as a filter that
+// allows everything.
+func NewNameFilter(createdAfter, createdBefore string, hostnames []string) (f *NameFilter, err error) {
+	f = &NameFilter{}
+	now := time.Now().UTC()
+	if createdAfter != "" {
+		if f.CreatedAfter, err = ParseDate(ResolveRelativeDate(createdAfter, now)); err != nil {
+			return nil, err
+		}
+	}
+	if createdBefore != "" {
+		if f.CreatedBefore, err = ParseDate(ResolveRelativeDate(createdBefore, now)); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range hostnames {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if f.Hostnames == nil {
+			f.Hostnames = map[string]struct{}{}
+		}
+		f.Hostnames[h] = struct{}{}
+	}
+	if f.CreatedAfter.IsZero() && f.CreatedBefore.IsZero() && f.Hostnames == nil {
+		return nil, nil
+	}
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() && !f.CreatedAfter.Before(f.CreatedBefore) {
+		return nil, fmt.Errorf("Empty creation time range %s to %s", createdAfter, createdBefore)
+	}
+	return f, nil
+}
+
+// Check whether an S3 key's name is within the filter's limits. Keys whose
+// names don't follow the split file convention never match.
+func (f *NameFilter) Allowed(key string) bool {
+	if f == nil {
+		return true
+	}
+	name, ok := ParseSplitFileName(key)
+	if !ok {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && name.Created.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !name.Created.Before(f.CreatedBefore) {
+		return false
+	}
+	if f.Hostnames != nil {
+		if _, ok := f.Hostnames[name.Hostname]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Pass on the listed keys whose names are allowed by the filter, along with
+// any errors.
+func FilterNames(ctx context.Context, results <-chan S3ListResult, f *NameFilter) <-chan S3ListResult {
+	if f == nil {
+		return results
+	}
+	return filterResults(ctx, results, func(k s3.Key) bool {
+		return f.Allowed(k.Key)
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
+	"github.com/bitly/go-notify"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"github.com/mreid-moz/golang-lru"
@@ -33,17 +34,31 @@ type S3SplitFileOutput struct {
 	processMessageFailures     int64
 	processMessageBytes        int64
 	encodeMessageFailures      int64
+	fallbackOtherCount         int64
+	fallbackMissingCount       int64
+	droppedMessageCount        int64
+	quarantinedMessageCount    int64
+	overflowMessageCount       int64
+	schemaReloadCount          int64
+	schemaReloadFailures       int64
 
 	*S3SplitFileOutputConfig
 	perm         os.FileMode
 	folderPerm   os.FileMode
 	timerChan    <-chan time.Time
+	refreshChan  <-chan time.Time
 	dimFiles     map[string]*SplitFileInfo
 	fopenCache   *lru.Cache
 	schema       Schema
+	cardinality  *CardinalityGuard
 	bucket       *s3.Bucket
 	publishChan  chan PublishAttempt
 	shuttingDown bool
+
+	// Protects schema and cardinality, which are replaced on reload. Held
+	// while reading them, including by the receiver.
+	schemaLock        sync.RWMutex
+	cardinalityWindow time.Duration
 }
 
 // ConfigStruct for S3SplitFileOutput plugin.
@@ -96,6 +111,11 @@ type S3SplitFileOutputConfig struct {
 	S3ConnectTimeout uint32 `toml:"s3_connect_timeout"`
 	S3ReadTimeout    uint32 `toml:"s3_read_timeout"`
 	S3WorkerCount    uint32 `toml:"s3_worker_count"`
+
+	// Specifies how long (in milliseconds) to remember the distinct values of
+	// dimensions with a `max_distinct_values` limit in the schema. The
+	// default of 0 means to use MaxFileAge.
+	CardinalityWindow uint32 `toml:"cardinality_window"`
 }
 
 // Info for a single split file
@@ -114,6 +134,12 @@ const (
 	stdFinalizedDir = "finalized"
 )
 
+// Type of the message injected with the result of each schema reload.
+const schemaReloadType = "heka.s3splitfile.schema-reload"
+
+// How often relative dates in the schema are re-evaluated.
+const schemaRefreshInterval = time.Minute
+
 func (o *S3SplitFileOutput) ConfigStruct() interface{} {
 	return &S3SplitFileOutputConfig{
 		Perm:             "644",
@@ -195,6 +221,13 @@ func (o *S3SplitFileOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("Parameter 'schema_file' must be a valid JSON file: %s", err)
 	}
 
+	cardinalityWindow := conf.CardinalityWindow
+	if cardinalityWindow == 0 {
+		cardinalityWindow = conf.MaxFileAge
+	}
+	o.cardinalityWindow = time.Duration(cardinalityWindow) * time.Millisecond
+	o.cardinality = NewCardinalityGuard(o.schema, o.cardinalityWindow)
+
 	if conf.S3Bucket != "" {
 		auth, err := aws.GetAuth(conf.AWSKey, conf.AWSSecretKey, "", time.Now())
 		if err != nil {
@@ -343,17 +376,97 @@ func (o *S3SplitFileOutput) finalizeOne(fi *SplitFileInfo) (err error) {
 
 func (o *S3SplitFileOutput) getNewFilename() (name string) {
 	// Mon Jan 2 15:04:05 -0700 MST 2006
-	return fmt.Sprintf("%s_%s", time.Now().UTC().Format("20060102150405.000"), hostname)
+	return fmt.Sprintf("%s_%s", time.Now().UTC().Format(SplitFileTimeLayout), hostname)
 }
 
-func (o *S3SplitFileOutput) getDimPath(pack *PipelinePack) (dimPath string) {
-	dims := o.schema.GetDimensions(pack)
+// Get the dimension paths for the given pack, updating the counters once for
+// the message, however many paths it has.
+func (o *S3SplitFileOutput) getDimPaths(pack *PipelinePack) (dimPaths []string) {
+	o.schemaLock.RLock()
+	defer o.schemaLock.RUnlock()
+
+	p := GetPartitions(&o.schema, o.cardinality, pack, time.Now().UTC())
+	if p.Other {
+		atomic.AddInt64(&o.fallbackOtherCount, 1)
+	}
+	if p.Missing {
+		atomic.AddInt64(&o.fallbackMissingCount, 1)
+	}
+	if p.Dropped {
+		atomic.AddInt64(&o.droppedMessageCount, 1)
+	}
+	if p.Quarantined {
+		atomic.AddInt64(&o.quarantinedMessageCount, 1)
+	}
+	if p.Overflow {
+		atomic.AddInt64(&o.overflowMessageCount, 1)
+	}
+	return p.DimPaths
+}
+
+// The partitions a message is written to, and what happened to its
+// dimensions on the way. Each flag is set if it applies to any of the
+// combinations of values the message fans out to.
+type Partitions struct {
+	DimPaths []string
+	// A dimension was replaced by its "other" value.
+	Other bool
+	// A dimension was replaced by its "missing" value.
+	Missing bool
+	// The message was dropped.
+	Dropped bool
+	// The message was written under the quarantine prefix.
+	Quarantined bool
+	// A dimension was replaced by its overflow value.
+	Overflow bool
+}
+
+// Get the dimension paths that S3SplitFileOutput writes a message to with the
+// given schema and cardinality guard (which may be nil). There is more than
+// one if the schema fans out a field with several values, and none if the
+// message should be dropped.
+func GetPartitions(schema *Schema, guard *CardinalityGuard, pack *PipelinePack, now time.Time) (p Partitions) {
+	var kept []DimensionResult
+	for _, result := range schema.CheckAllDimensions(pack) {
+		p.Other = p.Other || result.Other
+		p.Missing = p.Missing || result.Missing
+		if result.Drop {
+			p.Dropped = true
+			continue
+		}
+		p.Quarantined = p.Quarantined || result.Quarantine
+		kept = append(kept, result)
+	}
+
+	combinations := make([][]string, len(kept))
+	for i, result := range kept {
+		combinations[i] = result.Dims
+	}
+	p.Overflow = guard.CheckAll(combinations, now)
+
+	seen := map[string]struct{}{}
+	for _, result := range kept {
+		dimPath := getDimPath(schema, result)
+		if _, dup := seen[dimPath]; !dup {
+			seen[dimPath] = struct{}{}
+			p.DimPaths = append(p.DimPaths, dimPath)
+		}
+	}
+	return
+}
 
-	cleanDims := make([]string, len(dims))
-	for i, d := range dims {
-		cleanDims[i] = SanitizeDimension(d)
+// Get the dimension path for the given checked dimensions, which the message
+// is not to be dropped from.
+func getDimPath(schema *Schema, result DimensionResult) (dimPath string) {
+	cleanDims := make([]string, len(result.Dims))
+	for i, d := range result.Dims {
+		cleanDims[i] = schema.EncodeDimension(d)
 	}
-	return strings.Join(cleanDims, "/")
+	dimPath = strings.Join(cleanDims, "/")
+	if result.Quarantine {
+		dimPath = schema.QuarantinePrefix + "/" + dimPath
+	}
+	return dimPath
 }
 
 func (o *S3SplitFileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
@@ -369,12 +482,23 @@ func (o *S3SplitFileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		}
 	}
 
+	// Schema reload results are injected into the pipeline, and mustn't find
+	// their way back here.
+	spec := or.MatchRunner().MatcherSpecification()
+	for _, reloadErr := range []error{nil, errors.New("")} {
+		msg := new(message.Message)
+		setReloadMessage(msg, or.Name(), o.SchemaFile, reloadErr)
+		if spec.Match(msg) {
+			return fmt.Errorf("The message_matcher must not match messages of Type '%s'", schemaReloadType)
+		}
+	}
+
 	var (
 		wg sync.WaitGroup
 		i  uint32
 	)
 	wg.Add(1)
-	go o.receiver(or, &wg)
+	go o.receiver(or, h, &wg)
 	// Run a pool of concurrent publishers.
 	for i = 0; i < o.S3WorkerCount; i++ {
 		wg.Add(1)
@@ -385,7 +509,7 @@ func (o *S3SplitFileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 }
 
 // Runs in a separate goroutine, accepting incoming messages
-func (o *S3SplitFileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
+func (o *S3SplitFileOutput) receiver(or OutputRunner, h PluginHelper, wg *sync.WaitGroup) {
 	var (
 		pack          *PipelinePack
 		e             error
@@ -404,8 +528,17 @@ func (o *S3SplitFileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 		}
 	}
 
-	// TODO: listen for SIGHUP and finalize all current files.
-	//          see file_output.go for an example
+	// Re-evaluate relative dates in the schema as time goes by.
+	refreshTicker := time.NewTicker(schemaRefreshInterval)
+	defer refreshTicker.Stop()
+	if o.refreshChan == nil { // Tests might have set this already.
+		o.refreshChan = refreshTicker.C
+	}
+
+	// Reload the schema on SIGHUP.
+	hupChan := make(chan interface{})
+	notify.Start(RELOAD, hupChan)
+	defer notify.Stop(RELOAD, hupChan)
 
 	for ok {
 		select {
@@ -417,16 +550,10 @@ func (o *S3SplitFileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 				close(o.publishChan)
 				break
 			}
-			dimPath := o.getDimPath(pack)
-			// fmt.Printf("Found a path: %s\n", dimPath)
-			fileInfo, ok := o.dimFiles[dimPath]
-			if !ok {
-				fileInfo = &SplitFileInfo{
-					name:       filepath.Join(dimPath, o.getNewFilename()),
-					lastUpdate: time.Now().UTC(),
-					size:       0,
-				}
-				o.dimFiles[dimPath] = fileInfo
+			dimPaths := o.getDimPaths(pack)
+			if len(dimPaths) == 0 {
+				pack.Recycle(nil)
+				continue
 			}
 
 			// Encode the message
@@ -434,20 +561,8 @@ func (o *S3SplitFileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 				atomic.AddInt64(&o.encodeMessageFailures, 1)
 				or.LogError(e)
 			} else if outBytes != nil {
-				// Write to split file
-				doRotate, err := o.writeMessage(fileInfo, outBytes)
-
-				if err != nil {
-					or.LogError(fmt.Errorf("Error writing message to %s: %s", fileInfo.name, err))
-				}
-
-				if doRotate {
-					// Remove current file from the map (which will trigger the
-					// next record with this path to generate a new one)
-					delete(o.dimFiles, dimPath)
-					if e = o.finalizeOne(fileInfo); e != nil {
-						or.LogError(fmt.Errorf("Error finalizing %s: %s", fileInfo.name, e))
-					}
+				for _, dimPath := range dimPaths {
+					o.writeToPath(or, dimPath, outBytes)
 				}
 			}
 			// else the encoder did not emit a message.
@@ -458,11 +573,120 @@ func (o *S3SplitFileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 				or.LogError(fmt.Errorf("Error rotating files by time: %s", e))
 			}
 			timer.Reset(timerDuration)
+		case now := <-o.refreshChan:
+			o.refreshSchema(now.UTC())
+		case <-hupChan:
+			o.reloadSchema(or, h)
 		}
 	}
 	wg.Done()
 }
 
+// Load the schema file again and, if it is valid, finalize all current files
+// and start using the new schema. Otherwise keep using the old one. Either
+// way, the result is logged and injected into the pipeline as a message.
+func (o *S3SplitFileOutput) reloadSchema(or OutputRunner, h PluginHelper) {
+	finalizeErr, err := o.swapSchema()
+	if finalizeErr != nil {
+		or.LogError(fmt.Errorf("Error finalizing files before schema reload: %s", finalizeErr))
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("Error reloading schema, keeping the old one: %s", err))
+	} else {
+		or.LogMessage(fmt.Sprintf("Reloaded schema from %s", o.SchemaFile))
+	}
+
+	pack, e := h.PipelinePack(0)
+	if e != nil {
+		or.LogError(fmt.Errorf("Can't get a pack for the schema reload message: %s", e))
+		return
+	}
+	setReloadMessage(pack.Message, or.Name(), o.SchemaFile, err)
+	if !or.Inject(pack) {
+		or.LogError(fmt.Errorf("Can't inject the schema reload message"))
+	}
+}
+
+// Describe the result of a schema reload, which failed if err is set.
+func setReloadMessage(msg *message.Message, logger string, schemaFile string, err error) {
+	msg.SetType(schemaReloadType)
+	msg.SetLogger(logger)
+	msg.SetHostname(hostname)
+	msg.SetTimestamp(time.Now().UnixNano())
+	if err != nil {
+		msg.SetSeverity(3)
+		msg.SetPayload(fmt.Sprintf("Error reloading schema, keeping the old one: %s", err))
+	} else {
+		msg.SetSeverity(6)
+		msg.SetPayload(fmt.Sprintf("Reloaded schema from %s", schemaFile))
+	}
+	if field, e := message.NewField("SchemaFile", schemaFile, ""); e == nil {
+		msg.AddField(field)
+	}
+	if field, e := message.NewField("Success", err == nil, ""); e == nil {
+		msg.AddField(field)
+	}
+}
+
+// Re-evaluate any relative dates in the schema as of the given time.
+func (o *S3SplitFileOutput) refreshSchema(now time.Time) {
+	o.schemaLock.Lock()
+	o.schema.Refresh(now)
+	o.schemaLock.Unlock()
+}
+
+// Replace the schema with a freshly loaded one, finalizing the current files
+// first. If the schema can't be loaded, err is set and nothing changes.
+func (o *S3SplitFileOutput) swapSchema() (finalizeErr error, err error) {
+	atomic.AddInt64(&o.schemaReloadCount, 1)
+	schema, err := LoadSchema(o.SchemaFile)
+	if err != nil {
+		atomic.AddInt64(&o.schemaReloadFailures, 1)
+		return nil, err
+	}
+	schema.Refresh(time.Now().UTC())
+
+	finalizeErr = o.finalizeAll()
+	o.dimFiles = map[string]*SplitFileInfo{}
+
+	o.schemaLock.Lock()
+	o.schema = schema
+	o.cardinality = NewCardinalityGuard(schema, o.cardinalityWindow)
+	o.schemaLock.Unlock()
+	return finalizeErr, nil
+}
+
+// Write an encoded message to the current file for the given dimension path,
+// rotating the file if it's full.
+func (o *S3SplitFileOutput) writeToPath(or OutputRunner, dimPath string, outBytes []byte) {
+	// fmt.Printf("Found a path: %s\n", dimPath)
+	fileInfo, ok := o.dimFiles[dimPath]
+	if !ok {
+		fileInfo = &SplitFileInfo{
+			name:       filepath.Join(dimPath, o.getNewFilename()),
+			lastUpdate: time.Now().UTC(),
+			size:       0,
+		}
+		o.dimFiles[dimPath] = fileInfo
+	}
+
+	// Write to split file
+	doRotate, err := o.writeMessage(fileInfo, outBytes)
+
+	if err != nil {
+		or.LogError(fmt.Errorf("Error writing message to %s: %s", fileInfo.name, err))
+	}
+
+	if doRotate {
+		// Remove current file from the map (which will trigger the
+		// next record with this path to generate a new one)
+		delete(o.dimFiles, dimPath)
+		if e := o.finalizeOne(fileInfo); e != nil {
+			or.LogError(fmt.Errorf("Error finalizing %s: %s", fileInfo.name, e))
+		}
+	}
+}
+
 // Retry the given PublishAttempt by pushing it back on the channel with one
 // less attempt.  If we're out of retries, just log the error.
 // TODO: If we fail to publish a file, we should inject a failure message back
@@ -570,6 +794,26 @@ func (o *S3SplitFileOutput) ReportMsg(msg *message.Message) error {
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&o.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageBytes", atomic.LoadInt64(&o.processMessageBytes), "B")
 	message.NewInt64Field(msg, "EncodeMessageFailures", atomic.LoadInt64(&o.encodeMessageFailures), "count")
+	// Number of messages with at least one dimension replaced by its "other"
+	// or "missing" value, and what happened to them as a result. A message
+	// that fans out to several partitions is counted once if this happened
+	// in any of them.
+	message.NewInt64Field(msg, "FallbackOtherCount", atomic.LoadInt64(&o.fallbackOtherCount), "count")
+	message.NewInt64Field(msg, "FallbackMissingCount", atomic.LoadInt64(&o.fallbackMissingCount), "count")
+	message.NewInt64Field(msg, "DroppedMessageCount", atomic.LoadInt64(&o.droppedMessageCount), "count")
+	message.NewInt64Field(msg, "QuarantinedMessageCount", atomic.LoadInt64(&o.quarantinedMessageCount), "count")
+	// Number of messages with at least one dimension replaced by its overflow
+	// value, and the cardinality of each limited dimension.
+	message.NewInt64Field(msg, "OverflowMessageCount", atomic.LoadInt64(&o.overflowMessageCount), "count")
+	o.schemaLock.RLock()
+	cardinality := o.cardinality
+	o.schemaLock.RUnlock()
+	for _, c := range cardinality.Counts() {
+		message.NewInt64Field(msg, "DistinctValues."+c.Field, c.DistinctValues, "count")
+		message.NewInt64Field(msg, "OverflowCount."+c.Field, c.OverflowCount, "count")
+	}
+	message.NewInt64Field(msg, "SchemaReloadCount", atomic.LoadInt64(&o.schemaReloadCount), "count")
+	message.NewInt64Field(msg, "SchemaReloadFailures", atomic.LoadInt64(&o.schemaReloadFailures), "count")
 
 	return nil
 }
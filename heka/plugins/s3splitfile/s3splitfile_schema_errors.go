@@ -0,0 +1,220 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Describes a problem with a schema document, including where in the
+// document it was found.
+type SchemaError struct {
+	Name   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Column, e.Msg)
+}
+
+func newSchemaError(name string, data []byte, offset int, msg string) *SchemaError {
+	line, column := lineColumn(data, offset)
+	return &SchemaError{name, line, column, msg}
+}
+
+// Convert an error from unmarshalling a schema document into `v` into a
+// *SchemaError.
+func newJSONSchemaError(name string, data []byte, err error, v interface{}) *SchemaError {
+	offset := 0
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// The json package reports the offset just past the offending byte.
+		offset = int(e.Offset) - 1
+	case *json.UnmarshalTypeError:
+		offset = findTypeErrorOffset(data, v)
+	}
+	return newSchemaError(name, data, offset, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// Find the offset of the top-level value, or the dimension, that can't be
+// unmarshalled into `v`. The json package doesn't say where a type error is,
+// so each one is tried on its own. Returns 0 if none of them is at fault.
+func findTypeErrorOffset(data []byte, v interface{}) int {
+	t := reflect.TypeOf(v).Elem()
+	fails := func(key string, value []byte) bool {
+		doc := []byte(fmt.Sprintf("{%q: %s}", key, value))
+		return json.Unmarshal(doc, reflect.New(t).Interface()) != nil
+	}
+
+	offsets := findSchemaOffsets(data)
+	found := -1
+	for key, offset := range offsets.keys {
+		start := skipJSONSpace(data, skipJSONSpace(data, skipJSONValue(data, offset))+1)
+		if !fails(key, data[start:skipJSONValue(data, start)]) {
+			continue
+		}
+		if key == "dimensions" {
+			for _, dimOffset := range offsets.dimensions {
+				dim := data[dimOffset:skipJSONValue(data, dimOffset)]
+				if fails(key, []byte(fmt.Sprintf("[%s]", dim))) {
+					offset = dimOffset
+					break
+				}
+			}
+		}
+		// Keys are visited in no particular order, so report the first.
+		if found < 0 || offset < found {
+			found = offset
+		}
+	}
+	if found < 0 {
+		return 0
+	}
+	return found
+}
+
+// Get the (1-based) line and column of the given byte offset.
+func lineColumn(data []byte, offset int) (line int, column int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = offset - bytes.LastIndex(before, []byte("\n"))
+	return
+}
+
+// Byte offsets of the interesting parts of a schema document.
+type schemaOffsets struct {
+	// Offset of each top-level key.
+	keys map[string]int
+	// Offset of each element of the "dimensions" list.
+	dimensions []int
+}
+
+// Locate the top-level keys and the dimensions in a schema document. The
+// document must already be known to be valid JSON.
+func findSchemaOffsets(data []byte) (offsets schemaOffsets) {
+	offsets.keys = map[string]int{}
+	pos := skipJSONSpace(data, 0)
+	if pos >= len(data) || data[pos] != '{' {
+		return
+	}
+	pos++
+	for {
+		pos = skipJSONSpace(data, pos)
+		if pos >= len(data) || data[pos] != '"' {
+			return
+		}
+		keyEnd := skipJSONValue(data, pos)
+		var key string
+		json.Unmarshal(data[pos:keyEnd], &key)
+		offsets.keys[key] = pos
+
+		// Skip the ':'
+		pos = skipJSONSpace(data, keyEnd) + 1
+		pos = skipJSONSpace(data, pos)
+		if key == "dimensions" && pos < len(data) && data[pos] == '[' {
+			pos++
+			for {
+				pos = skipJSONSpace(data, pos)
+				if pos >= len(data) || data[pos] == ']' {
+					break
+				}
+				offsets.dimensions = append(offsets.dimensions, pos)
+				pos = skipJSONSpace(data, skipJSONValue(data, pos))
+				if pos < len(data) && data[pos] == ',' {
+					pos++
+				}
+			}
+			pos++
+		} else {
+			pos = skipJSONValue(data, pos)
+		}
+		pos = skipJSONSpace(data, pos)
+		if pos >= len(data) || data[pos] != ',' {
+			return
+		}
+		pos++
+	}
+}
+
+func skipJSONSpace(data []byte, pos int) int {
+	for pos < len(data) && strings.IndexByte(" \t\r\n", data[pos]) >= 0 {
+		pos++
+	}
+	return pos
+}
+
+// Return the offset just past the JSON value starting at `pos`.
+func skipJSONValue(data []byte, pos int) int {
+	if pos >= len(data) {
+		return pos
+	}
+	switch data[pos] {
+	case '"':
+		for pos++; pos < len(data); pos++ {
+			if data[pos] == '\\' {
+				pos++
+			} else if data[pos] == '"' {
+				return pos + 1
+			}
+		}
+		return pos
+	case '{', '[':
+		depth := 0
+		for pos < len(data) {
+			switch data[pos] {
+			case '"':
+				pos = skipJSONValue(data, pos)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return pos + 1
+				}
+			}
+			pos++
+		}
+		return pos
+	}
+	// A number or a literal.
+	for pos < len(data) && strings.IndexByte(",}] \t\r\n", data[pos]) < 0 {
+		pos++
+	}
+	return pos
+}
+
+// Describe the type of a value parsed from JSON.
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
+}
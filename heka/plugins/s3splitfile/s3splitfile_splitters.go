@@ -0,0 +1,86 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Ways of splitting an S3 file into records.
+const (
+	// Heka protobuf stream framing, as written by S3SplitFileOutput.
+	SplitterHekaFraming = "heka"
+	// Records ending with a single byte delimiter, such as newline-delimited
+	// JSON.
+	SplitterToken = "token"
+	// Records ending with a match of a regular expression.
+	SplitterRegex = "regex"
+	// The whole file is a single record.
+	SplitterWholeObject = "whole"
+)
+
+// Treats everything up to the end of the stream as a single record. Files
+// larger than the maximum record size can't be read this way.
+type WholeObjectSplitter struct{}
+
+func (w *WholeObjectSplitter) FindRecord(buf []byte) (bytesRead int, record []byte) {
+	// The record is whatever is left at the end of the stream.
+	return 0, nil
+}
+
+// Create a Splitter of one of the Splitter* types. The delimiter is the
+// delimiter byte for SplitterToken (newline if empty), or the expression
+// ending each record for SplitterRegex. It is ignored for the other types.
+func NewSplitter(splitterType string, delimiter string) (Splitter, error) {
+	switch splitterType {
+	case SplitterHekaFraming, "":
+		splitter := &HekaFramingSplitter{}
+		if err := splitter.Init(splitter.ConfigStruct()); err != nil {
+			return nil, fmt.Errorf("Error initializing HekaFramingSplitter: %s", err)
+		}
+		return splitter, nil
+	case SplitterToken:
+		splitter := &TokenSplitter{}
+		config := splitter.ConfigStruct().(*TokenSplitterConfig)
+		if delimiter != "" {
+			config.Delimiter = delimiter
+		}
+		if err := splitter.Init(config); err != nil {
+			return nil, fmt.Errorf("Error initializing TokenSplitter: %s", err)
+		}
+		return splitter, nil
+	case SplitterRegex:
+		if delimiter == "" {
+			return nil, fmt.Errorf("The regex splitter needs a delimiter")
+		}
+		splitter := &RegexSplitter{}
+		config := splitter.ConfigStruct().(*RegexSplitterConfig)
+		config.Delimiter = delimiter
+		if err := splitter.Init(config); err != nil {
+			return nil, fmt.Errorf("Error initializing RegexSplitter: %s", err)
+		}
+		return splitter, nil
+	case SplitterWholeObject:
+		return &WholeObjectSplitter{}, nil
+	}
+	return nil, fmt.Errorf("Unknown splitter '%s'", splitterType)
+}
+
+// Check whether splitters of the given type (see NewSplitter) find Heka
+// framed messages.
+func IsHekaFramingType(splitterType string) bool {
+	return splitterType == SplitterHekaFraming || splitterType == ""
+}
+
+// Check whether a splitter's records are Heka framed messages. Data left over
+// at the end of a framed stream is a truncated message, while for any other
+// splitter it is the final record.
+func isHekaFraming(splitter Splitter) bool {
+	_, ok := splitter.(*HekaFramingSplitter)
+	return ok
+}